@@ -14,7 +14,19 @@ var index = flag.String("index", "b+tree", "Index to be used")
 func main() {
 	flag.Parse()
 
-	db, err := kiwi.Open(*file, nil)
+	opts := kiwi.DefaultOptions
+	switch *index {
+	case "b+tree":
+		opts.IndexType = kiwi.BPlusTree
+	case "linearhash":
+		opts.IndexType = kiwi.LinearHash
+	case "exthash":
+		opts.IndexType = kiwi.ExtHash
+	default:
+		log.Fatalf("unknown index '%s' (must be 'b+tree', 'linearhash' or 'exthash')", *index)
+	}
+
+	db, err := kiwi.Open(*file, &opts)
 	if err != nil {
 		log.Fatalf("failed to open: %v", err)
 	}
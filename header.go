@@ -0,0 +1,86 @@
+package kiwi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/spy16/kiwi/pager"
+)
+
+const (
+	// magic marker to identify kiwi database files. hex version of 'kiwi'.
+	magic   = uint32(0x6B697769)
+	version = uint8(0x1)
+
+	headerSz = 6
+)
+
+// ErrIndexMismatch is returned by Open() when the database file was created
+// with a different index type than the one requested.
+var ErrIndexMismatch = errors.New("index type mismatch")
+
+// header is stored at the beginning of the first page of the database file
+// in little-endian byte order. Page size, page count and the creation time
+// are recorded in the pager header.
+//
+//	magic   (4 bytes) - magic marker 'kiwi'
+//	version (1 byte)  - version of the file layout
+//	index   (1 byte)  - type of the index used by the database
+type header struct {
+	magic     uint32
+	version   uint8
+	indexType IndexType
+}
+
+func (h header) validate(indexType IndexType) error {
+	if h.magic != magic {
+		return errors.New("invalid magic marker, not a kiwi database file")
+	} else if h.version != version {
+		return fmt.Errorf("incompatible version %#x (expected: %#x)", h.version, version)
+	} else if h.indexType != indexType {
+		return fmt.Errorf("%w: file uses %s, opened with %s", ErrIndexMismatch, h.indexType, indexType)
+	}
+	return nil
+}
+
+func (h header) MarshalBinary() ([]byte, error) {
+	d := make([]byte, headerSz)
+	binary.LittleEndian.PutUint32(d[0:4], h.magic)
+	d[4] = h.version
+	d[5] = uint8(h.indexType)
+	return d, nil
+}
+
+func (h *header) UnmarshalBinary(d []byte) error {
+	if len(d) < headerSz {
+		return fmt.Errorf("need at-least %d bytes, got only %d", headerSz, len(d))
+	}
+
+	h.magic = binary.LittleEndian.Uint32(d[0:4])
+	h.version = d[4]
+	h.indexType = IndexType(d[5])
+	return nil
+}
+
+// initHeader writes the header to the first page of the file if the file
+// is new, or reads and validates the existing header otherwise.
+func initHeader(p *pager.Pager, indexType IndexType) error {
+	if p.Count() == 0 {
+		if p.ReadOnly() {
+			return errors.New("cannot initialize database in read-only mode")
+		}
+
+		id, err := p.Alloc(1)
+		if err != nil {
+			return err
+		}
+		return p.Marshal(id, header{magic: magic, version: version, indexType: indexType})
+	}
+
+	h := header{}
+	if err := p.Unmarshal(0, &h); err != nil {
+		return err
+	}
+	return h.validate(indexType)
+}
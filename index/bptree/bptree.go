@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/spy16/kiwi/index"
 	"github.com/spy16/kiwi/pager"
@@ -18,6 +19,14 @@ import (
 // bin is the byte order used for all marshals/unmarshals.
 var bin = binary.LittleEndian
 
+// ErrUpgradeRequired is returned by Open() when the index file was written
+// using an older on-disk format. Use Upgrade() to migrate such files.
+var ErrUpgradeRequired = errors.New("index file uses an older format, upgrade required")
+
+// ErrCorrupted is returned when a page read from the index file does not
+// hold a valid node.
+var ErrCorrupted = errors.New("index page is corrupted")
+
 // Open opens the named file as a B+ tree index file and returns an instance
 // B+ tree for use. Use ":memory:" for an in-memory B+ tree instance for quick
 // testing setup. Degree of the tree is computed based on maxKeySize and pageSize
@@ -27,35 +36,149 @@ func Open(fileName string, opts *Options) (*BPlusTree, error) {
 		opts = &defaultOptions
 	}
 
-	p, err := pager.Open(fileName, opts.PageSize, opts.ReadOnly, opts.FileMode)
-	if err != nil {
+	if opts.SyncMode == pager.SyncPeriodic && opts.SyncInterval <= 0 {
+		return nil, errors.New("sync interval must be positive for periodic sync")
+	}
+
+	p, err := pager.Open(fileName, &pager.Options{
+		ReadOnly:    opts.ReadOnly,
+		FileMode:    opts.FileMode,
+		PageSize:    opts.PageSize,
+		LockTimeout: opts.LockTimeout,
+		IOMode:      opts.IOMode,
+		Owner:       pager.OwnerBPlusTree,
+	})
+	if err == pager.ErrNoHeader {
+		return nil, ErrUpgradeRequired
+	} else if err != nil {
 		return nil, err
 	}
 
+	return openTree(p, fileName, *opts)
+}
+
+// openTree opens the B+ tree stored in the pager. Pager is closed if the
+// tree cannot be opened.
+func openTree(p *pager.Pager, fileName string, opts Options) (*BPlusTree, error) {
 	tree := &BPlusTree{
-		mu:    &sync.RWMutex{},
-		file:  fileName,
-		pager: p,
-		root:  nil,
-		nodes: map[int]*node{},
+		mu:       &sync.RWMutex{},
+		file:     fileName,
+		pager:    p,
+		root:     nil,
+		nodes:    map[int]*node{},
+		syncMode: opts.SyncMode,
+		flush:    opts.FlushPolicy,
+		maxDirty: opts.MaxDirtyNodes,
 	}
 
 	// initialize the tree if new or open the existing tree and load
 	// root node.
-	if err := tree.open(*opts); err != nil {
+	if err := tree.open(opts); err != nil {
 		_ = tree.Close()
 		return nil, err
 	}
 
-	// compute B+ tree degree based on maxKeySize and page size.
-	if err := tree.computeDegree(int(tree.meta.pageSz)); err != nil {
+	// compute B+ tree degree based on maxKeySize and the space available
+	// in the page.
+	contentSz := int(tree.meta.pageSz)
+	if tree.meta.checksums() {
+		contentSz -= checksumSz
+	}
+	if err := tree.computeDegree(contentSz); err != nil {
 		_ = tree.Close()
 		return nil, err
 	}
 
+	if tree.syncMode == pager.SyncPeriodic && !p.ReadOnly() {
+		tree.stopSync = make(chan struct{})
+		tree.syncDone = make(chan struct{})
+		go tree.syncLoop(opts.SyncInterval)
+	}
+
 	return tree, nil
 }
 
+// Upgrade migrates the named B+ tree index file from older on-disk formats
+// to the current format in-place. Files written without the pager header
+// are migrated using pager.Migrate() and the v1 meta page is rewritten. Node
+// pages are layout compatible between v1 and v2. Pages in the free list of
+// the meta page are handed over to the pager. Upgrading a file that is
+// already in the current format is a no-op.
+func Upgrade(fileName string, opts *Options) error {
+	if opts == nil {
+		opts = &defaultOptions
+	} else if opts.ReadOnly {
+		return index.ErrImmutable
+	}
+
+	pageSize := opts.PageSize
+	if pageSize == 0 {
+		pageSize = os.Getpagesize()
+	}
+
+	if err := pager.Migrate(fileName, pageSize); err != nil {
+		return err
+	}
+
+	p, err := pager.Open(fileName, &pager.Options{
+		FileMode:    opts.FileMode,
+		PageSize:    opts.PageSize,
+		LockTimeout: opts.LockTimeout,
+		IOMode:      opts.IOMode,
+		Owner:       pager.OwnerBPlusTree,
+	})
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	if p.Count() == 0 {
+		return errors.New("cannot upgrade an empty file")
+	}
+
+	d, err := p.Read(0)
+	if err != nil {
+		return err
+	}
+
+	var meta metadata
+	if err := meta.UnmarshalBinary(d); err != nil {
+		return err
+	}
+
+	free, err := freePages(d)
+	if err != nil {
+		return err
+	}
+
+	if meta.version == versionV1 {
+		meta.magic = magic
+		meta.version = version
+		meta.flags |= featureUpgraded
+	} else if err := meta.validate(); err != nil {
+		return err
+	} else if len(free) == 0 {
+		return nil
+	}
+
+	if p.PageSize() != int(meta.pageSz) {
+		return errors.New("page size in meta does not match pager")
+	}
+
+	return releaseFreePages(p, meta, free)
+}
+
+// releaseFreePages rewrites the meta page without the free list left by
+// older versions and hands the pages over to the pager. Meta page is written
+// first, so that a crash in between leaks the pages instead of freeing them
+// twice.
+func releaseFreePages(p *pager.Pager, meta metadata, ids []int) error {
+	if err := p.Marshal(0, meta); err != nil {
+		return err
+	}
+	return p.Free(ids...)
+}
+
 // BPlusTree represents an on-disk B+ tree. Each node in the tree is mapped
 // to a single page in the file. Degree of the tree is decided based on the
 // page size and max key size while initializing.
@@ -68,8 +191,17 @@ type BPlusTree struct {
 	mu    *sync.RWMutex
 	pager *pager.Pager
 	nodes map[int]*node // node cache to avoid IO
+	dirty int           // number of dirty nodes in the cache
 	meta  metadata      // metadata about tree structure
 	root  *node         // current root node
+
+	// durability state
+	flush    FlushPolicy
+	maxDirty int
+	syncMode pager.SyncMode
+	syncErr  error         // error from the last background sync
+	stopSync chan struct{} // closed to stop background sync
+	syncDone chan struct{} // closed when background sync exits
 }
 
 // Get fetches the value associated with the given key. Returns error if key
@@ -86,28 +218,28 @@ func (tree *BPlusTree) Get(key []byte) (uint64, error) {
 		return 0, index.ErrKeyNotFound
 	}
 
-	n, idx, found, err := tree.searchRec(tree.root, key)
+	val, found, err := tree.lookup(key)
 	if err != nil {
 		return 0, err
 	} else if !found {
 		return 0, index.ErrKeyNotFound
 	}
 
-	return n.entries[idx].val, nil
+	return val, nil
 }
 
 // Put puts the key-value pair into the B+ tree. If the key already exists,
 // its value will be updated.
 func (tree *BPlusTree) Put(key []byte, val uint64) error {
-	if len(key) > int(tree.meta.maxKeySz) {
-		return index.ErrKeyTooLarge
-	} else if len(key) == 0 {
-		return index.ErrEmptyKey
-	}
-
 	tree.mu.Lock()
 	defer tree.mu.Unlock()
 
+	if err := tree.canMutate(key); err != nil {
+		return err
+	} else if len(key) > int(tree.meta.maxKeySz) {
+		return index.ErrKeyTooLarge
+	}
+
 	e := entry{
 		key: append([]byte(nil), key...),
 		val: val,
@@ -123,7 +255,39 @@ func (tree *BPlusTree) Put(key []byte, val uint64) error {
 		tree.meta.dirty = true
 	}
 
-	return tree.writeAll()
+	return tree.commitIfDue()
+}
+
+// Flush writes all the dirty nodes and the metadata to the underlying
+// pager. Flush is a commit point, i.e., pager is synced if the sync mode
+// is pager.SyncOnCommit.
+func (tree *BPlusTree) Flush() error {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	if tree.pager == nil {
+		return os.ErrClosed
+	}
+
+	return tree.commit()
+}
+
+// Sync flushes the dirty nodes and the metadata like Flush and syncs the
+// pager to stable storage regardless of the sync mode.
+func (tree *BPlusTree) Sync() error {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	if tree.pager == nil {
+		return os.ErrClosed
+	}
+
+	if err := tree.commit(); err != nil {
+		return err
+	} else if tree.syncMode == pager.SyncOnCommit {
+		return nil
+	}
+	return tree.pager.Sync()
 }
 
 // Del removes the key-value entry from the B+ tree. If the key does not
@@ -132,6 +296,10 @@ func (tree *BPlusTree) Del(key []byte) (uint64, error) {
 	tree.mu.Lock()
 	defer tree.mu.Unlock()
 
+	if err := tree.canMutate(key); err != nil {
+		return 0, err
+	}
+
 	target, idx, found, err := tree.searchRec(tree.root, key)
 	if err != nil {
 		return 0, err
@@ -140,7 +308,10 @@ func (tree *BPlusTree) Del(key []byte) (uint64, error) {
 	}
 
 	e := target.removeAt(idx)
-	return e.val, nil
+	tree.meta.size--
+	tree.meta.dirty = true
+
+	return e.val, tree.commitIfDue()
 }
 
 // Scan performs an index scan starting at the given key. Each entry will be
@@ -222,6 +393,12 @@ func (tree *BPlusTree) Size() int64 { return int64(tree.meta.size) }
 
 // Close flushes any writes and closes the underlying pager.
 func (tree *BPlusTree) Close() error {
+	if tree.stopSync != nil {
+		close(tree.stopSync)
+		<-tree.syncDone
+		tree.stopSync = nil
+	}
+
 	tree.mu.Lock()
 	defer tree.mu.Unlock()
 
@@ -229,9 +406,22 @@ func (tree *BPlusTree) Close() error {
 		return nil
 	}
 
-	_ = tree.writeAll() // write if any nodes are pending
+	flushErr := tree.writeAll() // write if any nodes are pending
+	syncErr := tree.syncErr
+	if flushErr != nil {
+		syncErr = flushErr
+	}
+	if tree.syncMode != pager.SyncNone {
+		if err := tree.pager.Sync(); err != nil {
+			syncErr = err
+		}
+	}
+
 	err := tree.pager.Close()
 	tree.pager = nil
+	if err == nil {
+		err = syncErr
+	}
 	return err
 }
 
@@ -258,7 +448,7 @@ func (tree *BPlusTree) put(e entry) (bool, error) {
 		// update the tree root
 		newRoot.children = append(newRoot.children, oldRoot.id)
 		tree.root = newRoot
-		tree.meta.rootID = uint32(newRoot.id)
+		tree.meta.rootID = uint64(newRoot.id)
 
 		if err := tree.split(newRoot, oldRoot, rightSibling, 0); err != nil {
 			return false, err
@@ -318,9 +508,9 @@ func (tree *BPlusTree) insertInternal(n *node, e entry) (bool, error) {
 }
 
 func (tree *BPlusTree) split(p, n, sibling *node, i int) error {
-	p.dirty = true
-	n.dirty = true
-	sibling.dirty = true
+	p.markDirty()
+	n.markDirty()
+	sibling.markDirty()
 
 	if len(n.children) == 0 {
 		// split leaf node. use 'sibling' as the right node for 'n'.
@@ -375,6 +565,63 @@ func (tree *BPlusTree) searchRec(n *node, key []byte) (*node, int, bool, error)
 	return tree.searchRec(child, key)
 }
 
+// lookup finds the value of the key starting from the root. Cached nodes
+// are searched in-memory and the rest are searched directly on the page
+// bytes using pager.View() without decoding or caching them. Pages of trees
+// without featureSlots are decoded and cached instead.
+func (tree *BPlusTree) lookup(key []byte) (uint64, bool, error) {
+	id := tree.root.id
+	for {
+		if n, cached := tree.nodes[id]; cached {
+			idx, found := n.search(key)
+			if n.isLeaf() {
+				if !found {
+					return 0, false, nil
+				}
+				return n.entries[idx].val, true, nil
+			}
+
+			if found {
+				idx++
+			}
+			id = n.children[idx]
+			continue
+		} else if !tree.meta.slots() {
+			// pages without the slot array cannot be searched in place.
+			if _, err := tree.fetch(id); err != nil {
+				return 0, false, err
+			}
+			continue
+		}
+
+		var leaf, found bool
+		var ref uint64
+		err := tree.pager.View(id, func(d []byte) error {
+			v := nodeView(d)
+			if tree.meta.checksums() {
+				if err := verifyPage(d); err != nil {
+					return err
+				}
+			}
+
+			var err error
+			if _, found, ref, err = v.search(key); err != nil {
+				return err
+			}
+			leaf = v.isLeaf()
+			return nil
+		})
+		if err != nil {
+			return 0, false, err
+		}
+
+		if leaf {
+			return ref, found, nil
+		}
+		id = int(ref)
+	}
+}
+
 // rightLeaf returns the right most leaf node of the sub-tree with given node
 // as the root.
 func (tree *BPlusTree) rightLeaf(n *node) (*node, error) {
@@ -421,16 +668,35 @@ func (tree *BPlusTree) fetch(id int) (*node, error) {
 		return n, nil
 	}
 
-	n = newNode(id, int(tree.meta.pageSz))
-	if err := tree.pager.Unmarshal(id, n); err != nil {
+	d, err := tree.pager.Read(id)
+	if err != nil {
+		return nil, err
+	} else if tree.meta.checksums() {
+		if err := verifyPage(d); err != nil {
+			return nil, err
+		}
+	}
+
+	n = newNode(id, tree.meta.slots())
+	if err := n.UnmarshalBinary(d); err != nil {
 		return nil, err
 	}
 	n.dirty = false
-	tree.nodes[n.id] = n
+	tree.cache(n)
 
 	return n, nil
 }
 
+// cache adds the node to the node cache and tracks it in the dirty node
+// counter.
+func (tree *BPlusTree) cache(n *node) {
+	n.pending = &tree.dirty
+	if n.dirty {
+		tree.dirty++
+	}
+	tree.nodes[n.id] = n
+}
+
 // allocOne allocates a page in the underlying pager and creates a node
 // on that page. node is not written to the page in this call.
 func (tree *BPlusTree) allocOne() (*node, error) {
@@ -441,30 +707,18 @@ func (tree *BPlusTree) allocOne() (*node, error) {
 	return nodes[0], nil
 }
 
-// alloc allocates pages required for 'n' new nodes. alloc will reuse
-// pages from free-list if available.
+// alloc allocates pages required for 'n' new nodes. Pages released to the
+// pager, including the ones pre-allocated by init(), are reused first.
 func (tree *BPlusTree) alloc(n int) ([]*node, error) {
-	// check if there are enough free pages from the freelist
-	// and try to allocate sequential set of pages.
-	pid, rem := allocSeq(tree.meta.freeList, n)
-	tree.meta.freeList = rem
-
-	// free list could be having less pages than we actually need.
-	// we need to allocate if that is the case.
-	if pid < 0 {
-		var err error
-		pid, err = tree.pager.Alloc(n)
+	nodes := make([]*node, n)
+	for i := 0; i < n; i++ {
+		id, err := tree.pager.Alloc(1)
 		if err != nil {
 			return nil, err
 		}
-	}
 
-	nodes := make([]*node, n)
-	for i := 0; i < n; i++ {
-		n := newNode(pid, int(tree.meta.pageSz))
-		tree.nodes[pid] = n
-		nodes[i] = n
-		pid++
+		nodes[i] = newNode(id, tree.meta.slots())
+		tree.cache(nodes[i])
 	}
 
 	return nodes, nil
@@ -479,17 +733,33 @@ func (tree *BPlusTree) open(opts Options) error {
 	}
 
 	// we are opening an initialized index file. read page 0 as metadata.
-	if err := tree.pager.Unmarshal(0, &tree.meta); err != nil {
+	d, err := tree.pager.Read(0)
+	if err != nil {
+		return err
+	} else if err := tree.meta.UnmarshalBinary(d); err != nil {
 		return err
 	}
 
 	// verify metadata
-	if tree.meta.version != version {
-		return fmt.Errorf("incompatible version %#x (expected: %#x)", tree.meta.version, version)
+	if err := tree.meta.validate(); err != nil {
+		return err
 	} else if tree.pager.PageSize() != int(tree.meta.pageSz) {
 		return errors.New("page size in meta does not match pager")
 	}
 
+	// files written by older versions may have a free list in the meta
+	// page, hand it over to the pager.
+	if !tree.pager.ReadOnly() {
+		free, err := freePages(d)
+		if err != nil {
+			return err
+		} else if len(free) > 0 {
+			if err := releaseFreePages(tree.pager, tree.meta, free); err != nil {
+				return err
+			}
+		}
+	}
+
 	// read the root node
 	root, err := tree.fetch(int(tree.meta.rootID))
 	if err != nil {
@@ -502,46 +772,128 @@ func (tree *BPlusTree) open(opts Options) error {
 
 // init initializes a new B+ tree in the underlying file. allocates 2 pages
 // (1 for meta + 1 for root) and initializes the instance. metadata and the
-// root node are expected to be written to file during insertion.
+// root node are expected to be written to file during insertion. PreAlloc
+// pages are allocated along and released to the pager for later reuse.
 func (tree *BPlusTree) init(opts Options) error {
 	_, err := tree.pager.Alloc(2 + opts.PreAlloc)
 	if err != nil {
 		return err
 	}
 
-	tree.root = newNode(1, tree.pager.PageSize())
-	tree.nodes[tree.root.id] = tree.root
+	// free in reverse, so that the pages are reused in order. +2 since
+	// first 2 pages are reserved.
+	if opts.PreAlloc > 0 {
+		ids := make([]int, opts.PreAlloc)
+		for i := range ids {
+			ids[i] = opts.PreAlloc + 1 - i
+		}
+		if err := tree.pager.Free(ids...); err != nil {
+			return err
+		}
+	}
 
 	tree.meta = metadata{
 		dirty:    true,
+		magic:    magic,
 		version:  version,
-		flags:    0,
+		flags:    featureChecksums,
 		size:     0,
 		rootID:   1,
 		pageSz:   uint32(tree.pager.PageSize()),
 		maxKeySz: uint16(opts.MaxKeySize),
 	}
+	if tree.pager.PageSize() <= maxSlotsPageSz {
+		tree.meta.flags |= featureSlots
+	}
+
+	tree.root = newNode(1, tree.meta.slots())
+	tree.cache(tree.root)
 
-	tree.meta.freeList = make([]int, opts.PreAlloc)
-	for i := 0; i < opts.PreAlloc; i++ {
-		tree.meta.freeList[i] = i + 2 // +2 since first 2 pages reserved
+	return nil
+}
+
+// commit writes all dirty nodes and syncs the pager if the sync mode
+// requires. Error from a failed background sync is reported here once.
+func (tree *BPlusTree) commit() error {
+	if err := tree.syncErr; err != nil {
+		tree.syncErr = nil
+		return err
 	}
 
+	if err := tree.writeAll(); err != nil {
+		return err
+	}
+
+	if tree.syncMode == pager.SyncOnCommit {
+		return tree.pager.Sync()
+	}
 	return nil
 }
 
-// writeAll writes all the nodes marked dirty to the underlying pager.
+// commitIfDue commits after a mutation unless the flush policy defers it.
+func (tree *BPlusTree) commitIfDue() error {
+	if tree.flush == FlushDeferred {
+		if tree.maxDirty <= 0 || tree.dirty < tree.maxDirty {
+			return nil
+		}
+	}
+
+	return tree.commit()
+}
+
+// syncLoop syncs the pager at every interval until stopSync is closed.
+func (tree *BPlusTree) syncLoop(interval time.Duration) {
+	defer close(tree.syncDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tree.stopSync:
+			return
+
+		case <-ticker.C:
+			tree.mu.Lock()
+			if tree.pager != nil {
+				if err := tree.writeAll(); err != nil {
+					tree.syncErr = err
+				} else if err := tree.pager.Sync(); err != nil {
+					tree.syncErr = err
+				}
+			}
+			tree.mu.Unlock()
+		}
+	}
+}
+
+// writeAll writes all the nodes marked dirty to the underlying pager. Nodes
+// are written in one batch so that nodes on adjacent pages are coalesced.
 func (tree *BPlusTree) writeAll() error {
 	if tree.pager.ReadOnly() {
 		return nil
 	}
 
+	pages := map[int][]byte{}
 	for _, n := range tree.nodes {
 		if n.dirty {
-			if err := tree.pager.Marshal(n.id, n); err != nil {
+			d, err := n.MarshalBinary()
+			if err != nil {
 				return err
+			} else if tree.meta.checksums() {
+				d = sealPage(d, int(tree.meta.pageSz))
 			}
-			n.dirty = false
+			pages[n.id] = d
+		}
+	}
+
+	if len(pages) > 0 {
+		if err := tree.pager.WriteMany(pages); err != nil {
+			return err
+		}
+
+		for id := range pages {
+			tree.nodes[id].markClean()
 		}
 	}
 
@@ -558,11 +910,15 @@ func (tree *BPlusTree) writeMeta() error {
 	return nil
 }
 
-func (tree *BPlusTree) canMutate() error {
+// canMutate returns error if the tree cannot be modified using the key.
+// Caller must hold mu.
+func (tree *BPlusTree) canMutate(key []byte) error {
 	if tree.pager == nil {
 		return os.ErrClosed
 	} else if tree.pager.ReadOnly() {
 		return index.ErrImmutable
+	} else if len(key) == 0 {
+		return index.ErrEmptyKey
 	}
 	return nil
 }
@@ -580,6 +936,10 @@ func (tree *BPlusTree) computeDegree(pageSz int) error {
 
 	leafEntrySize := int(valueSz + 2 + tree.meta.maxKeySz)
 	internalEntrySize := int(childPtrSz + keySizeSpecSz + tree.meta.maxKeySz)
+	if tree.meta.slots() {
+		leafEntrySize += slotSz
+		internalEntrySize += slotSz
+	}
 
 	// 4 bytes extra for the one extra child pointer
 	tree.degree = (internalContentSz - 4) / (2 * internalEntrySize)
@@ -590,30 +950,3 @@ func (tree *BPlusTree) computeDegree(pageSz int) error {
 	}
 	return nil
 }
-
-// allocSeq finds a subset of size 'n' in 'free' that is sequential.
-// Returns the first int in the sequence the set after removing the
-// subset.
-func allocSeq(free []int, n int) (id int, remaining []int) {
-	if len(free) <= n {
-		return -1, free
-	} else if n == 1 {
-		return free[0], free[1:]
-	}
-
-	i, j := 0, 0
-	for ; i < len(free); i++ {
-		j = i + (n - 1)
-		if j < len(free) && free[j] == free[i]+(n-1) {
-			break
-		}
-	}
-
-	if i >= len(free) || j >= len(free) {
-		return -1, free
-	}
-
-	id = free[i]
-	free = append(free[:i], free[j+1:]...)
-	return id, free
-}
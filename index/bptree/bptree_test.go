@@ -2,10 +2,16 @@ package bptree
 
 import (
 	"hash/fnv"
+	"io/ioutil"
 	"log"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/spy16/kiwi/index"
+	"github.com/spy16/kiwi/pager"
 )
 
 const (
@@ -126,6 +132,393 @@ func TestBPlusTree_Put_Get(t *testing.T) {
 	})
 }
 
+func TestBPlusTree_Del(t *testing.T) {
+	tree, err := Open(":memory:", nil)
+	if err != nil {
+		t.Fatalf("failed to init tree: %v", err)
+	}
+	defer tree.Close()
+
+	for i := 0; i < 1000; i++ {
+		if err := tree.Put([]byte{byte(i >> 8), byte(i)}, uint64(i)); err != nil {
+			t.Fatalf("Put() unexpected error: %v", err)
+		}
+	}
+
+	for i := 0; i < 1000; i += 2 {
+		v, err := tree.Del([]byte{byte(i >> 8), byte(i)})
+		if err != nil || v != uint64(i) {
+			t.Fatalf("Del(%d) expected %d, got %d (err=%v)", i, i, v, err)
+		}
+	}
+
+	if tree.Size() != 500 {
+		t.Errorf("expected tree size to be 500, got %d", tree.Size())
+	}
+
+	for i := 0; i < 1000; i++ {
+		v, err := tree.Get([]byte{byte(i >> 8), byte(i)})
+		if i%2 == 0 && err != index.ErrKeyNotFound {
+			t.Errorf("Get(%d) expected ErrKeyNotFound after Del(), got %d (err=%v)", i, v, err)
+		} else if i%2 == 1 && (err != nil || v != uint64(i)) {
+			t.Errorf("Get(%d) expected %d, got %d (err=%v)", i, i, v, err)
+		}
+	}
+
+	if _, err := tree.Del([]byte{0, 0}); err != index.ErrKeyNotFound {
+		t.Errorf("Del() expected ErrKeyNotFound for deleted key, got %v", err)
+	}
+}
+
+func TestBPlusTree_Get_View(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "view.idx")
+
+	tree, err := Open(fileName, nil)
+	if err != nil {
+		t.Fatalf("failed to init tree: %v", err)
+	}
+	writeLot(t, tree, 5000)
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	tree, err = Open(fileName, &Options{ReadOnly: true, PageSize: os.Getpagesize()})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer tree.Close()
+
+	readCheck(t, tree, 5000)
+
+	// lookups must search pages in-place without caching the nodes.
+	if len(tree.nodes) != 1 {
+		t.Errorf("expected only root node to be cached, got %d nodes", len(tree.nodes))
+	}
+}
+
+func TestBPlusTree_ReadOnly(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "readonly.idx")
+
+	tree, err := Open(fileName, nil)
+	if err != nil {
+		t.Fatalf("failed to init tree: %v", err)
+	}
+	writeLot(t, tree, 100)
+	if _, err := tree.Del(nil); err != index.ErrEmptyKey {
+		t.Errorf("Del() expected ErrEmptyKey, got %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	tree, err = Open(fileName, &Options{ReadOnly: true, PageSize: os.Getpagesize()})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer tree.Close()
+
+	key := []byte{0, 0, 0, 10}
+	if _, err := tree.Del(key); err != index.ErrImmutable {
+		t.Errorf("Del() expected ErrImmutable, got %v", err)
+	}
+	if err := tree.Put(key, 1); err != index.ErrImmutable {
+		t.Errorf("Put() expected ErrImmutable, got %v", err)
+	}
+
+	// failed mutations must not change the in-memory state.
+	if tree.Size() != 100 {
+		t.Errorf("expected size 100, got %d", tree.Size())
+	}
+	readCheck(t, tree, 100)
+}
+
+func TestUpgrade(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "v1.idx")
+
+	tree, err := Open(fileName, nil)
+	if err != nil {
+		t.Fatalf("failed to init tree: %v", err)
+	}
+	writeLot(t, tree, 1000)
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	// rewrite the meta page the way v1 implementation would have, with
+	// some unused pages in the free list.
+	p, err := pager.Open(fileName, &pager.Options{FileMode: 0644, PageSize: os.Getpagesize()})
+	if err != nil {
+		t.Fatalf("failed to open pager: %v", err)
+	}
+	meta := metadata{}
+	if err := p.Unmarshal(0, &meta); err != nil {
+		t.Fatalf("failed to read meta: %v", err)
+	}
+	freeID, err := p.Alloc(2)
+	if err != nil {
+		t.Fatalf("failed to alloc pages: %v", err)
+	}
+	meta.magic = 0
+	meta.version = versionV1
+	if err := p.Write(0, marshalV1(meta, []int{freeID, freeID + 1})); err != nil {
+		t.Fatalf("failed to write v1 meta: %v", err)
+	}
+	_ = p.Close()
+
+	// v1 files do not have the pager header page.
+	d, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if err := ioutil.WriteFile(fileName, d[os.Getpagesize():], 0644); err != nil {
+		t.Fatalf("failed to strip pager header: %v", err)
+	}
+
+	if _, err := Open(fileName, nil); err != ErrUpgradeRequired {
+		t.Fatalf("Open() expected ErrUpgradeRequired, got %v", err)
+	}
+
+	if err := Upgrade(fileName, nil); err != nil {
+		t.Fatalf("Upgrade() unexpected error: %v", err)
+	}
+
+	if err := Upgrade(fileName, nil); err != nil {
+		t.Fatalf("Upgrade() expected no-op on current format, got %v", err)
+	}
+
+	tree, err = Open(fileName, nil)
+	if err != nil {
+		t.Fatalf("Open() after upgrade unexpected error: %v", err)
+	}
+	defer tree.Close()
+
+	if tree.meta.flags&featureUpgraded == 0 {
+		t.Errorf("expected upgraded feature flag to be set")
+	}
+	if tree.Size() != 1000 {
+		t.Errorf("expected tree size to be 1000, got %d", tree.Size())
+	}
+	readCheck(t, tree, 1000)
+
+	// freed pages must be reused by new nodes.
+	pages := tree.pager.Count()
+	if id, err := tree.pager.Alloc(1); err != nil || id != freeID+1 {
+		t.Errorf("expected page %d to be reused, got %d (err=%v)", freeID+1, id, err)
+	}
+	if tree.pager.Count() != pages {
+		t.Errorf("expected no new pages, count %d != %d", tree.pager.Count(), pages)
+	}
+}
+
+func TestBPlusTree_LargePage(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "large.idx")
+	opts := &Options{FileMode: 0644, PageSize: 2 * maxSlotsPageSz, MaxKeySize: 100}
+
+	tree, err := Open(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to init tree: %v", err)
+	}
+	if tree.meta.slots() {
+		t.Errorf("expected no slot array for page size %d", opts.PageSize)
+	}
+	writeLot(t, tree, 5000)
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	// nodes are not cached after reopen, so lookups decode the pages.
+	tree, err = Open(fileName, opts)
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer tree.Close()
+	readCheck(t, tree, 5000)
+}
+
+func TestBPlusTree_PreAlloc(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "prealloc.idx")
+
+	tree, err := Open(fileName, &Options{FileMode: 0644, PageSize: os.Getpagesize(), MaxKeySize: 100, PreAlloc: 4})
+	if err != nil {
+		t.Fatalf("failed to init tree: %v", err)
+	}
+	defer tree.Close()
+
+	if tree.pager.Count() != 6 {
+		t.Errorf("expected 6 pages, got %d", tree.pager.Count())
+	}
+
+	// pre-allocated pages are handed out in order before growing the file.
+	for want := 2; want < 6; want++ {
+		n, err := tree.allocOne()
+		if err != nil || n.id != want {
+			t.Errorf("expected page %d to be reused, got %v (err=%v)", want, n, err)
+		}
+	}
+	if tree.pager.Count() != 6 {
+		t.Errorf("expected no new pages, got %d", tree.pager.Count())
+	}
+}
+
+func TestBPlusTree_LegacyFreeList(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "legacy.idx")
+
+	tree, err := Open(fileName, nil)
+	if err != nil {
+		t.Fatalf("failed to init tree: %v", err)
+	}
+	writeLot(t, tree, 1000)
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	// older versions kept the unused pages in the meta page.
+	p, err := pager.Open(fileName, &pager.Options{FileMode: 0644, PageSize: os.Getpagesize()})
+	if err != nil {
+		t.Fatalf("failed to open pager: %v", err)
+	}
+	freeID, err := p.Alloc(2)
+	if err != nil {
+		t.Fatalf("failed to alloc pages: %v", err)
+	}
+	d, err := p.Read(0)
+	if err != nil {
+		t.Fatalf("failed to read meta: %v", err)
+	}
+	bin.PutUint32(d[26:30], 2)
+	bin.PutUint32(d[metadataHeaderSize:], uint32(freeID))
+	bin.PutUint32(d[metadataHeaderSize+4:], uint32(freeID+1))
+	if err := p.Write(0, sealPage(d, len(d))); err != nil {
+		t.Fatalf("failed to write meta: %v", err)
+	}
+	_ = p.Close()
+
+	tree, err = Open(fileName, nil)
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer tree.Close()
+	readCheck(t, tree, 1000)
+
+	d, err = tree.pager.Read(0)
+	if err != nil {
+		t.Fatalf("failed to read meta: %v", err)
+	}
+	if free, err := freePages(d); err != nil || len(free) != 0 {
+		t.Errorf("expected free list to be handed over to pager, got %v (err=%v)", free, err)
+	}
+
+	pages := tree.pager.Count()
+	if id, err := tree.pager.Alloc(1); err != nil || id != freeID+1 {
+		t.Errorf("expected page %d to be reused, got %d (err=%v)", freeID+1, id, err)
+	}
+	if tree.pager.Count() != pages {
+		t.Errorf("expected no new pages, count %d != %d", tree.pager.Count(), pages)
+	}
+}
+
+func TestBPlusTree_FlushDeferred(t *testing.T) {
+	tree, err := Open(":memory:", &Options{
+		PageSize:    os.Getpagesize(),
+		MaxKeySize:  100,
+		FlushPolicy: FlushDeferred,
+	})
+	if err != nil {
+		t.Fatalf("failed to init tree: %v", err)
+	}
+	defer tree.Close()
+
+	for i := 0; i < 10000; i++ {
+		if err := tree.Put([]byte("hot-key"), uint64(i)); err != nil {
+			t.Fatalf("Put() unexpected error: %v", err)
+		}
+	}
+
+	if writes := tree.pager.Stats().Writes; writes != 0 {
+		t.Errorf("expected no page writes before Flush(), got %d", writes)
+	}
+
+	if err := tree.Flush(); err != nil {
+		t.Fatalf("Flush() unexpected error: %v", err)
+	}
+
+	// one write for the root node and one for the meta page.
+	if writes := tree.pager.Stats().Writes; writes != 2 {
+		t.Errorf("expected 2 page writes after Flush(), got %d", writes)
+	}
+
+	v, err := tree.Get([]byte("hot-key"))
+	if err != nil || v != 9999 {
+		t.Errorf("Get() expected 9999, got %d (err=%v)", v, err)
+	}
+}
+
+func TestBPlusTree_FlushThreshold(t *testing.T) {
+	tree, err := Open(":memory:", &Options{
+		PageSize:      os.Getpagesize(),
+		MaxKeySize:    4,
+		FlushPolicy:   FlushDeferred,
+		MaxDirtyNodes: 8,
+	})
+	if err != nil {
+		t.Fatalf("failed to init tree: %v", err)
+	}
+	defer tree.Close()
+
+	writeLot(t, tree, 10000)
+	if tree.dirty >= 8 {
+		t.Errorf("expected dirty nodes to stay below threshold, got %d", tree.dirty)
+	}
+
+	dirty := 0
+	for _, n := range tree.nodes {
+		if n.dirty {
+			dirty++
+		}
+	}
+	if dirty != tree.dirty {
+		t.Errorf("expected dirty node counter to be %d, got %d", dirty, tree.dirty)
+	}
+	if tree.pager.Stats().Writes == 0 {
+		t.Errorf("expected threshold to trigger page writes")
+	}
+	readCheck(t, tree, 10000)
+	scanLot(t, tree, 10000)
+}
+
+func TestBPlusTree_SyncMode(t *testing.T) {
+	_, err := Open(":memory:", &Options{
+		PageSize:   os.Getpagesize(),
+		MaxKeySize: 100,
+		SyncMode:   pager.SyncPeriodic,
+	})
+	if err == nil {
+		t.Errorf("Open() expected error for periodic sync without interval")
+	}
+
+	for _, mode := range []pager.SyncMode{pager.SyncNone, pager.SyncOnCommit, pager.SyncPeriodic} {
+		t.Run(mode.String(), func(t *testing.T) {
+			tree, err := Open(filepath.Join(t.TempDir(), "sync.idx"), &Options{
+				FileMode:     0644,
+				PageSize:     os.Getpagesize(),
+				MaxKeySize:   4,
+				SyncMode:     mode,
+				SyncInterval: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("Open() unexpected error: %v", err)
+			}
+
+			writeLot(t, tree, 500)
+			readCheck(t, tree, 500)
+
+			if err := tree.Close(); err != nil {
+				t.Errorf("Close() unexpected error: %v", err)
+			}
+		})
+	}
+}
+
 func BenchmarkBPlusTree_Put_Get(b *testing.B) {
 	tree, err := Open(":memory:", nil)
 	if err != nil {
@@ -0,0 +1,147 @@
+package bptree
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/spy16/kiwi/pager"
+)
+
+// crashKeys is the number of keys inserted by the crash workload.
+const crashKeys = 150
+
+func TestBPlusTree_Crash(t *testing.T) {
+	t.Parallel()
+
+	// dry run to find the number of operations in the workload.
+	dry := pager.NewFaultFile("crash.db", nil)
+	if err := crashWorkload(dry); err != nil {
+		t.Fatalf("workload failed without crash: %v", err)
+	}
+	ops := len(dry.Ops())
+	if ops == 0 {
+		t.Fatalf("workload did not write to the file")
+	}
+
+	// every third key inserted is followed by a delete.
+	count, err := checkCrashImage(dry.Image())
+	if err != nil {
+		t.Fatalf("workload left an invalid image without crash: %v", err)
+	} else if want := crashKeys - crashKeys/3; count != want {
+		t.Fatalf("expected %d entries after workload, got %d", want, count)
+	}
+
+	// page writes are either applied fully or not at all with tear=0, so the
+	// tree must never hold garbage. Torn writes (tear > 0) must be caught by
+	// the page checksums.
+	for _, tear := range []int{0, 100} {
+		opened, corrupted := 0, 0
+		for n := 0; n < ops; n++ {
+			f := pager.NewFaultFile("crash.db", nil)
+			f.CrashAt(n, tear)
+			if err := crashWorkload(f); err == nil || !f.Crashed() {
+				t.Fatalf("crash at %d (%s): expected workload to fail, got %v", n, dry.Ops()[n], err)
+			}
+
+			_, err := checkCrashImage(f.Image())
+			switch err.(type) {
+			case nil:
+				opened++
+
+			case crashPanic, crashMismatch:
+				t.Fatalf("crash at %d (%s, tear=%d): %v", n, dry.Ops()[n], tear, err)
+
+			default:
+				corrupted++
+			}
+		}
+		t.Logf("tear=%d: %d crash points, %d opened, %d reported corruption",
+			tear, ops, opened, corrupted)
+	}
+}
+
+// crashWorkload inserts keys into a new tree on the file, deleting some of
+// them along the way.
+func crashWorkload(f *pager.FaultFile) error {
+	opts := Options{FileMode: 0644, PageSize: 512, MaxKeySize: 16}
+
+	p, err := pager.OpenFile(f, &pager.Options{PageSize: opts.PageSize, GrowthChunk: 4096})
+	if err != nil {
+		return err
+	}
+
+	tree, err := openTree(p, f.Name(), opts)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < crashKeys; i++ {
+		if err := tree.Put(crashKey(i), uint64(i)); err != nil {
+			_ = tree.Close()
+			return err
+		}
+
+		if i%3 == 2 {
+			if _, err := tree.Del(crashKey(i - 1)); err != nil {
+				_ = tree.Close()
+				return err
+			}
+		}
+	}
+
+	return tree.Close()
+}
+
+// crashPanic is returned by checkCrashImage when reading the image panics.
+type crashPanic struct{ v interface{} }
+
+func (cp crashPanic) Error() string { return fmt.Sprintf("panic: %v", cp.v) }
+
+// crashMismatch is returned by checkCrashImage when the tree opens but holds
+// entries never written by the workload, i.e., the corruption went unnoticed.
+type crashMismatch string
+
+func (cm crashMismatch) Error() string { return string(cm) }
+
+// checkCrashImage opens the tree in the image, verifies that all the entries
+// are readable and map to the values written by the workload and returns the
+// number of entries. Errors other than crashPanic and crashMismatch mean the
+// corruption was detected.
+func checkCrashImage(image []byte) (count int, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = crashPanic{v: v}
+		}
+	}()
+
+	p, err := pager.OpenFile(pager.NewFaultFile("crash.db", image), &pager.Options{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+
+	tree, err := openTree(p, "crash.db", Options{ReadOnly: true, PageSize: 512, MaxKeySize: 16})
+	if err != nil {
+		return 0, err
+	}
+	defer tree.Close()
+
+	var scanErr error
+	err = tree.Scan(nil, false, func(key []byte, v uint64) bool {
+		count++
+		if string(key) != string(crashKey(int(v))) {
+			scanErr = crashMismatch(fmt.Sprintf("key '%s' has unexpected value %d", key, v))
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return 0, err
+	} else if scanErr != nil {
+		return 0, scanErr
+	} else if int64(count) != tree.Size() {
+		return 0, fmt.Errorf("scanned %d entries, size is %d", count, tree.Size())
+	}
+	return count, nil
+}
+
+func crashKey(i int) []byte { return []byte(fmt.Sprintf("key-%04d", i)) }
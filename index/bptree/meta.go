@@ -2,13 +2,44 @@ package bptree
 
 import (
 	"errors"
-	"log"
+	"fmt"
 )
 
 const (
-	magic              = 0xD0D
-	version            = uint8(0x1)
-	metadataHeaderSize = 16
+	magic   = uint16(0xD0D)
+	version = uint8(0x2)
+
+	// versionV1 is the legacy format. v1 files never wrote the magic marker,
+	// stored 32-bit counters and wrote the free list one byte before where it
+	// was read from. Such files must be migrated using Upgrade().
+	versionV1 = uint8(0x1)
+
+	metadataHeaderSize   = 30
+	metadataHeaderSizeV1 = 22
+)
+
+// Feature flags stored in the metadata 'flags' field. Files with any flag
+// not in knownFeatures are rejected on open.
+const (
+	// featureUpgraded is set on files that were migrated in-place from
+	// the v1 format.
+	featureUpgraded = uint8(1 << 0)
+
+	// featureChecksums is set on trees whose node and meta pages end with
+	// a checksum of the rest of the page, so that torn writes are detected.
+	// Upgraded files do not have it since their pages were written without.
+	featureChecksums = uint8(1 << 1)
+
+	// featureSlots is set on trees whose node pages store an array of entry
+	// offsets after the header, so that pages can be binary searched without
+	// decoding. Upgraded files and page sizes beyond the reach of the 16-bit
+	// offsets use the plain layout.
+	featureSlots = uint8(1 << 2)
+
+	knownFeatures = featureUpgraded | featureChecksums | featureSlots
+
+	// maxSlotsPageSz is the largest page size that can use featureSlots.
+	maxSlotsPageSz = 1 << 16
 )
 
 // metadata represents the metadata for the B+ tree stored in a file.
@@ -19,49 +50,71 @@ type metadata struct {
 	// actual metadata
 	magic    uint16 // magic marker to identify B+ tree.
 	version  uint8  // version of implementation
-	flags    uint8  // flags (unused)
+	flags    uint8  // feature flags
 	maxKeySz uint16 // maximum key size allowed
 	pageSz   uint32 // page size used to initialize
-	size     uint32 // number of entries in the tree
-	rootID   uint32 // page id for the root node
-	freeList []int  // list of allocated, unused pages
+	size     uint64 // number of entries in the tree
+	rootID   uint64 // page id for the root node
 }
 
+// validate verifies that the metadata read from the file describes a v2 B+
+// tree that this implementation can open.
+func (m metadata) validate() error {
+	if m.version == versionV1 {
+		return ErrUpgradeRequired
+	} else if m.version != version {
+		return fmt.Errorf("incompatible version %#x (expected: %#x)", m.version, version)
+	} else if m.magic != magic {
+		return errors.New("invalid magic marker, not a B+ tree file")
+	} else if unknown := m.flags &^ knownFeatures; unknown != 0 {
+		return fmt.Errorf("unsupported feature flags %#x", unknown)
+	}
+	return nil
+}
+
+// checksums returns true if the pages of the tree carry checksums.
+func (m metadata) checksums() bool { return m.flags&featureChecksums != 0 }
+
+// slots returns true if the node pages of the tree have the slot array.
+func (m metadata) slots() bool { return m.flags&featureSlots != 0 }
+
+// MarshalBinary always encodes the metadata in the current (v2) format. Free
+// pages are tracked by the pager, so the free list is always written empty.
 func (m metadata) MarshalBinary() ([]byte, error) {
 	buf := make([]byte, m.pageSz)
 
-	// verify that the free list can fit inside the meta page.
-	freeListSpace := int(m.pageSz) - metadataHeaderSize
-	if len(m.freeList)*4 > freeListSpace {
-		// TODO: make sure this doesn't happen by compacting pager
-		// when free page count hits a threshold
-		log.Printf("WARNING: truncating free list since it doesn't fit in meta page")
-		m.freeList = m.freeList[:freeListSpace/4]
-	}
-
 	bin.PutUint16(buf[0:2], m.magic)
 	buf[2] = m.version
 	buf[3] = m.flags
 	bin.PutUint16(buf[4:6], m.maxKeySz)
 	bin.PutUint32(buf[6:10], m.pageSz)
-	bin.PutUint32(buf[10:14], m.size)
-	bin.PutUint32(buf[14:18], m.rootID)
-	bin.PutUint32(buf[18:22], uint32(len(m.freeList)))
+	bin.PutUint64(buf[10:18], m.size)
+	bin.PutUint64(buf[18:26], m.rootID)
+	bin.PutUint32(buf[26:30], 0) // free list size
 
-	offset := 21
-	for i := 0; i < len(m.freeList); i++ {
-		bin.PutUint32(buf[offset:offset+4], uint32(m.freeList[i]))
-		offset += 4
+	if m.checksums() {
+		return sealPage(buf, int(m.pageSz)), nil
 	}
-
 	return buf, nil
 }
 
+// UnmarshalBinary decodes both v1 and v2 meta pages. The version field can
+// be used to detect legacy files.
 func (m *metadata) UnmarshalBinary(d []byte) error {
-	if len(d) < metadataHeaderSize {
-		return errors.New("in-sufficient data for unmarshal")
-	} else if m == nil {
+	if m == nil {
 		return errors.New("cannot unmarshal into nil")
+	} else if len(d) < metadataHeaderSizeV1 {
+		return errors.New("in-sufficient data for unmarshal")
+	}
+
+	if d[2] == versionV1 {
+		return m.unmarshalV1(d)
+	} else if len(d) < metadataHeaderSize {
+		return errors.New("in-sufficient data for unmarshal")
+	} else if d[3]&featureChecksums != 0 {
+		if err := verifyPage(d); err != nil {
+			return err
+		}
 	}
 
 	m.magic = bin.Uint16(d[0:2])
@@ -69,15 +122,49 @@ func (m *metadata) UnmarshalBinary(d []byte) error {
 	m.flags = d[3]
 	m.maxKeySz = bin.Uint16(d[4:6])
 	m.pageSz = bin.Uint32(d[6:10])
-	m.size = bin.Uint32(d[10:14])
-	m.rootID = bin.Uint32(d[14:18])
+	m.size = bin.Uint64(d[10:18])
+	m.rootID = bin.Uint64(d[18:26])
 
-	m.freeList = make([]int, bin.Uint32(d[18:22]))
-	offset := 22
-	for i := 0; i < len(m.freeList); i++ {
-		m.freeList[i] = int(bin.Uint32(d[offset : offset+4]))
-		offset += 4
-	}
+	return nil
+}
+
+// unmarshalV1 decodes the legacy v1 meta page.
+func (m *metadata) unmarshalV1(d []byte) error {
+	m.magic = bin.Uint16(d[0:2])
+	m.version = d[2]
+	m.flags = d[3]
+	m.maxKeySz = bin.Uint16(d[4:6])
+	m.pageSz = bin.Uint32(d[6:10])
+	m.size = uint64(bin.Uint32(d[10:14]))
+	m.rootID = uint64(bin.Uint32(d[14:18]))
 
 	return nil
 }
+
+// freePages decodes the free list of a v1 or v2 meta page. Older versions
+// kept unused pages in the meta page, which must be handed over to the
+// pager. v1 wrote the free list starting at offset 21 which clobbers the
+// most significant byte of the free list size. Since a meta page can never
+// hold 2^24 ids, the low 3 bytes of the size and the ids at offset 21 are
+// still intact.
+func freePages(d []byte) ([]int, error) {
+	var freeSz, offset int
+	if len(d) >= metadataHeaderSizeV1 && d[2] == versionV1 {
+		freeSz, offset = int(bin.Uint32(d[18:22])&0x00FFFFFF), 21
+	} else if len(d) >= metadataHeaderSize {
+		freeSz, offset = int(bin.Uint32(d[26:30])), metadataHeaderSize
+	} else {
+		return nil, errors.New("in-sufficient data for unmarshal")
+	}
+
+	if offset+freeSz*4 > len(d) {
+		return nil, errors.New("free list size exceeds meta page")
+	}
+
+	ids := make([]int, freeSz)
+	for i := range ids {
+		ids[i] = int(bin.Uint32(d[offset : offset+4]))
+		offset += 4
+	}
+	return ids, nil
+}
@@ -7,14 +7,13 @@ import (
 
 func Test_metadata_Binary(t *testing.T) {
 	original := metadata{
-		magic:    0xD0D0,
-		version:  0x1,
+		magic:    magic,
+		version:  version,
 		flags:    0xFD,
 		maxKeySz: 100,
 		pageSz:   4096,
 		rootID:   10,
-		size:     1000,
-		freeList: []int{},
+		size:     1 << 40,
 	}
 
 	d, err := original.MarshalBinary()
@@ -30,4 +29,61 @@ func Test_metadata_Binary(t *testing.T) {
 	if !reflect.DeepEqual(original, got) {
 		t.Errorf("want=%#v\ngot=%#v", original, got)
 	}
+
+	if free, err := freePages(d); err != nil || len(free) != 0 {
+		t.Errorf("freePages() expected empty free list, got %v (err=%v)", free, err)
+	}
+}
+
+func Test_metadata_UnmarshalV1(t *testing.T) {
+	want := metadata{
+		version:  versionV1,
+		maxKeySz: 100,
+		pageSz:   4096,
+		rootID:   10,
+		size:     1000,
+	}
+	wantFree := []int{2, 3, 0x01020304}
+
+	d := marshalV1(want, wantFree)
+	got := metadata{}
+	if err := got.UnmarshalBinary(d); err != nil {
+		t.Fatalf("UnmarshalBinary() unexpected error: %#v", err)
+	}
+
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want=%#v\ngot=%#v", want, got)
+	}
+
+	if err := got.validate(); err != ErrUpgradeRequired {
+		t.Errorf("validate() expected ErrUpgradeRequired, got %#v", err)
+	}
+
+	free, err := freePages(d)
+	if err != nil {
+		t.Fatalf("freePages() unexpected error: %#v", err)
+	}
+	if !reflect.DeepEqual(wantFree, free) {
+		t.Errorf("freePages() want=%v, got=%v", wantFree, free)
+	}
+}
+
+// marshalV1 encodes the metadata exactly the way the v1 implementation did
+// including the misplaced free list.
+func marshalV1(m metadata, free []int) []byte {
+	buf := make([]byte, m.pageSz)
+	buf[2] = m.version
+	buf[3] = m.flags
+	bin.PutUint16(buf[4:6], m.maxKeySz)
+	bin.PutUint32(buf[6:10], m.pageSz)
+	bin.PutUint32(buf[10:14], uint32(m.size))
+	bin.PutUint32(buf[14:18], uint32(m.rootID))
+	bin.PutUint32(buf[18:22], uint32(len(free)))
+
+	offset := 21
+	for _, id := range free {
+		bin.PutUint32(buf[offset:offset+4], uint32(id))
+		offset += 4
+	}
+	return buf
 }
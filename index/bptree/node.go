@@ -4,28 +4,42 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+
+	"github.com/spy16/kiwi/index"
 )
 
 const (
 	leafNodeHeaderSz     = 11
 	internalNodeHeaderSz = 3
 
+	// checksumSz is the space reserved at the end of the pages for the
+	// checksum if the tree has featureChecksums.
+	checksumSz = 4
+
+	// slotSz is the size of an entry offset in the slot array stored in
+	// node pages of trees with featureSlots.
+	slotSz = 2
+
 	flagLeafNode     = uint8(0x0)
 	flagInternalNode = uint8(0x1)
 )
 
-// newNode initializes an in-memory leaf node and returns.
-func newNode(id int, pageSz int) *node {
+// newNode initializes an in-memory leaf node and returns. 'slots' must be
+// set if the tree stores the entry offset array in its node pages.
+func newNode(id int, slots bool) *node {
 	return &node{
 		id:    id,
 		dirty: true,
+		slots: slots,
 	}
 }
 
 // node represents an internal or leaf node in the B+ tree.
 type node struct {
 	// configs for read/write
-	dirty bool
+	dirty   bool
+	pending *int // dirty node counter of the tree, updated by markDirty()
+	slots   bool // encode the entry offset array (featureSlots)
 
 	// node data
 	id       int
@@ -61,9 +75,31 @@ func (n node) search(key []byte) (idx int, found bool) {
 	return lo, false
 }
 
+// markDirty marks the node as pending a write.
+func (n *node) markDirty() {
+	if n.dirty {
+		return
+	}
+	n.dirty = true
+	if n.pending != nil {
+		*n.pending++
+	}
+}
+
+// markClean marks the node as written.
+func (n *node) markClean() {
+	if !n.dirty {
+		return
+	}
+	n.dirty = false
+	if n.pending != nil {
+		*n.pending--
+	}
+}
+
 // insertChild adds the given child at appropriate location under the node.
 func (n *node) insertChild(idx int, child *node) {
-	n.dirty = true
+	n.markDirty()
 	n.children = append(n.children, 0)
 	copy(n.children[idx+1:], n.children[idx:])
 	n.children[idx] = child.id
@@ -71,7 +107,7 @@ func (n *node) insertChild(idx int, child *node) {
 
 // insertAt inserts the entry at the given index into the node.
 func (n *node) insertAt(idx int, e entry) {
-	n.dirty = true
+	n.markDirty()
 	n.entries = append(n.entries, entry{})
 	copy(n.entries[idx+1:], n.entries[idx:])
 	n.entries[idx] = e
@@ -80,16 +116,16 @@ func (n *node) insertAt(idx int, e entry) {
 // removeAt removes the entry at given index and returns the value
 // that existed.
 func (n *node) removeAt(idx int) entry {
-	n.dirty = true
+	n.markDirty()
 	e := n.entries[idx]
-	n.entries = append(n.entries[:idx], n.entries[idx:]...)
+	n.entries = append(n.entries[:idx], n.entries[idx+1:]...)
 	return e
 }
 
 // update updates the value of the entry with given index.
 func (n *node) update(entryIdx int, val uint64) {
 	if val != n.entries[entryIdx].val {
-		n.dirty = true
+		n.markDirty()
 		n.entries[entryIdx].val = val
 	}
 }
@@ -113,8 +149,13 @@ func (n node) String() string {
 }
 
 func (n node) size() int {
+	sz := 0
+	if n.slots {
+		sz += slotSz * len(n.entries)
+	}
+
 	if n.isLeaf() {
-		sz := leafNodeHeaderSz
+		sz += leafNodeHeaderSz
 		for i := 0; i < len(n.entries); i++ {
 			// 2 for the key size, 8 for the uint64 value
 			sz += 2 + 8 + len(n.entries[i].key)
@@ -123,7 +164,7 @@ func (n node) size() int {
 
 	}
 
-	sz := internalNodeHeaderSz + 4 // +4 for the extra child pointer
+	sz += internalNodeHeaderSz + 4 // +4 for the extra child pointer
 	for i := 0; i < len(n.entries); i++ {
 		// 4 for the child pointer, 2 for the key size
 		sz += 4 + 2 + len(n.entries[i].key)
@@ -149,9 +190,19 @@ func (n node) MarshalBinary() ([]byte, error) {
 		bin.PutUint32(buf[offset:offset+4], uint32(n.prev))
 		offset += 4
 
+		slot := offset
+		if n.slots {
+			offset += slotSz * len(n.entries)
+		}
+
 		for i := 0; i < len(n.entries); i++ {
 			e := n.entries[i]
 
+			if n.slots {
+				bin.PutUint16(buf[slot:slot+slotSz], uint16(offset))
+				slot += slotSz
+			}
+
 			bin.PutUint64(buf[offset:offset+8], e.val)
 			offset += 8
 
@@ -173,9 +224,19 @@ func (n node) MarshalBinary() ([]byte, error) {
 		bin.PutUint32(buf[offset:offset+4], uint32(n.children[0]))
 		offset += 4
 
+		slot := offset
+		if n.slots {
+			offset += slotSz * len(n.entries)
+		}
+
 		for i := 0; i < len(n.entries); i++ {
 			e := n.entries[i]
 
+			if n.slots {
+				bin.PutUint16(buf[slot:slot+slotSz], uint16(offset))
+				slot += slotSz
+			}
+
 			bin.PutUint32(buf[offset:offset+4], uint32(n.children[i+1]))
 			offset += 4
 
@@ -206,6 +267,11 @@ func (n *node) UnmarshalBinary(d []byte) error {
 		n.prev = int(bin.Uint32(d[offset : offset+4]))
 		offset += 4
 
+		// entries are stored in order after the slot array.
+		if n.slots {
+			offset += slotSz * entryCount
+		}
+
 		for i := 0; i < entryCount; i++ {
 			e := entry{}
 			e.val = bin.Uint64(d[offset : offset+8])
@@ -229,6 +295,10 @@ func (n *node) UnmarshalBinary(d []byte) error {
 		n.children = append(n.children, int(bin.Uint32(d[offset:offset+4])))
 		offset += 4 // we are at offset 7 now
 
+		if n.slots {
+			offset += slotSz * entryCount
+		}
+
 		for i := 0; i < entryCount; i++ {
 			childPtr := bin.Uint32(d[offset : offset+4])
 			offset += 4
@@ -249,7 +319,125 @@ func (n *node) UnmarshalBinary(d []byte) error {
 	return nil
 }
 
+// sealPage pads the page data to the page size and stores the checksum of
+// the page in its last checksumSz bytes.
+func sealPage(d []byte, pageSz int) []byte {
+	if len(d) < pageSz {
+		d = append(d, make([]byte, pageSz-len(d))...)
+	}
+	end := len(d) - checksumSz
+	bin.PutUint32(d[end:], index.Checksum(d[:end]))
+	return d
+}
+
+// verifyPage returns ErrCorrupted if the checksum stored in the page does
+// not match its contents.
+func verifyPage(d []byte) error {
+	if len(d) < checksumSz {
+		return ErrCorrupted
+	}
+	end := len(d) - checksumSz
+	if bin.Uint32(d[end:]) != index.Checksum(d[:end]) {
+		return ErrCorrupted
+	}
+	return nil
+}
+
 type entry struct {
 	key []byte
 	val uint64
 }
+
+// nodeView provides read access to an encoded node page without decoding
+// it. Used to search pages directly in the memory mapped region. Only pages
+// of trees with featureSlots can be viewed.
+type nodeView []byte
+
+func (v nodeView) isLeaf() bool { return v[0]&flagInternalNode == 0 }
+
+// search performs a binary search for the key directly on the page bytes
+// using the slot array. Returns the index where the key should be and a
+// flag indicating whether the key exists. For leaf nodes, 'ref' is the
+// value of the key if found. For internal nodes, 'ref' is the id of the
+// child to descend into. Returns ErrCorrupted if the slots or the entries
+// do not fit in the page.
+func (v nodeView) search(key []byte) (idx int, found bool, ref uint64, err error) {
+	if len(v) < internalNodeHeaderSz {
+		return 0, false, 0, ErrCorrupted
+	}
+	leaf := v.isLeaf()
+	count := int(bin.Uint16(v[1:3]))
+
+	// ptrSz is the size of the value or the child pointer preceding the
+	// key in an entry.
+	slots, ptrSz := internalNodeHeaderSz+4, 4
+	if leaf {
+		slots, ptrSz = leafNodeHeaderSz, 8
+	}
+	if slots+slotSz*count > len(v) {
+		return 0, false, 0, ErrCorrupted
+	}
+
+	lo, hi := 0, count-1
+	for lo <= hi {
+		mid := (hi + lo) / 2
+
+		_, k, err := v.entry(slots+slotSz*mid, ptrSz)
+		if err != nil {
+			return 0, false, 0, err
+		}
+
+		cmp := bytes.Compare(key, k)
+		if cmp == 0 {
+			lo, found = mid, true
+			break
+		} else if cmp > 0 {
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	idx = lo
+
+	if leaf {
+		if found {
+			offset, _, _ := v.entry(slots+slotSz*idx, ptrSz)
+			ref = bin.Uint64(v[offset : offset+8])
+		}
+		return idx, found, ref, nil
+	}
+
+	// child i+1 is stored before the key i and the 0th child after header.
+	child := idx
+	if found {
+		child++
+	}
+
+	if child == 0 {
+		ref = uint64(bin.Uint32(v[internalNodeHeaderSz : internalNodeHeaderSz+4]))
+		return idx, found, ref, nil
+	}
+
+	offset, _, err := v.entry(slots+slotSz*(child-1), ptrSz)
+	if err != nil {
+		return 0, false, 0, err
+	}
+	ref = uint64(bin.Uint32(v[offset : offset+4]))
+	return idx, found, ref, nil
+}
+
+// entry returns the offset of the entry referenced by the slot at the given
+// offset and its key.
+func (v nodeView) entry(slot, ptrSz int) (int, []byte, error) {
+	offset := int(bin.Uint16(v[slot : slot+slotSz]))
+	if offset+ptrSz+2 > len(v) {
+		return 0, nil, ErrCorrupted
+	}
+
+	keyAt := offset + ptrSz + 2
+	keySz := int(bin.Uint16(v[offset+ptrSz : keyAt]))
+	if keyAt+keySz > len(v) {
+		return 0, nil, ErrCorrupted
+	}
+	return offset, v[keyAt : keyAt+keySz], nil
+}
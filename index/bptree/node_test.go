@@ -36,56 +36,154 @@ func Test_node_Search(t *testing.T) {
 }
 
 func Test_node_Leaf_Binary(t *testing.T) {
-	original := node{
-		id: 10,
-		entries: []entry{
-			{key: []byte("hello"), val: 10},
-			{key: []byte("world"), val: 100},
-		},
-		next: 13,
-		prev: 10,
+	for _, slots := range []bool{false, true} {
+		original := node{
+			id: 10,
+			entries: []entry{
+				{key: []byte("hello"), val: 10},
+				{key: []byte("world"), val: 100},
+			},
+			next:  13,
+			prev:  10,
+			slots: slots,
+		}
+
+		d, err := original.MarshalBinary()
+		if err != nil {
+			t.Fatalf("failed to marshal: %#v", err)
+		}
+		assert(t, len(d) == original.size(), "expected %d bytes, got %d", original.size(), len(d))
+		original.id = 0
+
+		got := node{slots: slots}
+		if err := got.UnmarshalBinary(d); err != nil {
+			t.Fatalf("failed to unmarshal: %#v", err)
+		}
+
+		if !reflect.DeepEqual(original, got) {
+			t.Errorf("want=%#v\ngot=%#v", original, got)
+		}
 	}
+}
 
-	d, err := original.MarshalBinary()
-	if err != nil {
-		t.Fatalf("failed to marshal: %#v", err)
+func Test_node_Internal_Binary(t *testing.T) {
+	for _, slots := range []bool{false, true} {
+		original := node{
+			id: 10,
+			entries: []entry{
+				{key: []byte("hello")},
+				{key: []byte("world")},
+			},
+			children: []int{3, 18, 4},
+			slots:    slots,
+		}
+
+		d, err := original.MarshalBinary()
+		if err != nil {
+			t.Fatalf("failed to marshal: %#v", err)
+		}
+		assert(t, len(d) == original.size(), "expected %d bytes, got %d", original.size(), len(d))
+		original.id = 0
+
+		got := node{slots: slots}
+		if err := got.UnmarshalBinary(d); err != nil {
+			t.Fatalf("failed to unmarshal: %#v", err)
+		}
+
+		if !reflect.DeepEqual(original, got) {
+			t.Errorf("want=%#v\ngot=%#v", original, got)
+		}
 	}
-	original.id = 0
+}
+
+func Test_nodeView_Search(t *testing.T) {
+	keys := []string{"B", "D", "F", "H"}
 
-	got := node{}
-	if err := got.UnmarshalBinary(d); err != nil {
-		t.Fatalf("failed to unmarshal: %#v", err)
+	leaf := node{slots: true}
+	internal := node{children: []int{100}, slots: true}
+	for i, k := range keys {
+		leaf.entries = append(leaf.entries, entry{key: []byte(k), val: uint64(i + 1)})
+		internal.entries = append(internal.entries, entry{key: []byte(k)})
+		internal.children = append(internal.children, 101+i)
 	}
 
-	if !reflect.DeepEqual(original, got) {
-		t.Errorf("want=%#v\ngot=%#v", original, got)
+	leafPage, _ := leaf.MarshalBinary()
+	internalPage, _ := internal.MarshalBinary()
+
+	for _, key := range []string{"A", "B", "C", "D", "E", "F", "G", "H", "I"} {
+		wantIdx, wantFound := leaf.search([]byte(key))
+
+		idx, found, ref, err := nodeView(leafPage).search([]byte(key))
+		assert(t, err == nil, "leaf search('%s'): unexpected error: %v", key, err)
+		assert(t, idx == wantIdx && found == wantFound,
+			"leaf search('%s'): expected (%d, %t), got (%d, %t)", key, wantIdx, wantFound, idx, found)
+		if found {
+			assert(t, ref == leaf.entries[idx].val,
+				"leaf search('%s'): expected value %d, got %d", key, leaf.entries[idx].val, ref)
+		}
+
+		child := wantIdx
+		if wantFound {
+			child++
+		}
+
+		idx, found, ref, err = nodeView(internalPage).search([]byte(key))
+		assert(t, err == nil, "internal search('%s'): unexpected error: %v", key, err)
+		assert(t, idx == wantIdx && found == wantFound,
+			"internal search('%s'): expected (%d, %t), got (%d, %t)", key, wantIdx, wantFound, idx, found)
+		assert(t, ref == uint64(internal.children[child]),
+			"internal search('%s'): expected child %d, got %d", key, internal.children[child], ref)
 	}
+
+	assert(t, nodeView(leafPage).isLeaf(), "expected leaf page")
+	assert(t, !nodeView(internalPage).isLeaf(), "expected internal page")
 }
 
-func Test_node_Internal_Binary(t *testing.T) {
-	original := node{
-		id: 10,
-		entries: []entry{
-			{key: []byte("hello")},
-			{key: []byte("world")},
-		},
-		children: []int{3, 18, 4},
+func Test_nodeView_Search_Corrupted(t *testing.T) {
+	n := node{slots: true}
+	for _, k := range []string{"B", "D", "F", "H"} {
+		n.entries = append(n.entries, entry{key: []byte(k)})
 	}
+	page, _ := n.MarshalBinary()
 
-	d, err := original.MarshalBinary()
-	if err != nil {
-		t.Fatalf("failed to marshal: %#v", err)
-	}
-	original.id = 0
+	tooMany := append([]byte(nil), page...)
+	bin.PutUint16(tooMany[1:3], 100)
+
+	// key size of the 2nd entry, which is the first one bisected.
+	bigKey := append([]byte(nil), page...)
+	second := int(bin.Uint16(page[leafNodeHeaderSz+slotSz:]))
+	bin.PutUint16(bigKey[second+8:], 1000)
 
-	got := node{}
-	if err := got.UnmarshalBinary(d); err != nil {
-		t.Fatalf("failed to unmarshal: %#v", err)
+	badSlot := append([]byte(nil), page...)
+	bin.PutUint16(badSlot[leafNodeHeaderSz+slotSz:], uint16(len(page)))
+
+	for name, d := range map[string][]byte{
+		"empty":     nil,
+		"truncated": page[:leafNodeHeaderSz-1],
+		"count":     tooMany,
+		"key size":  bigKey,
+		"slot":      badSlot,
+	} {
+		_, _, _, err := nodeView(d).search([]byte("E"))
+		assert(t, err == ErrCorrupted, "%s: expected ErrCorrupted, got %v", name, err)
 	}
+}
 
-	if !reflect.DeepEqual(original, got) {
-		t.Errorf("want=%#v\ngot=%#v", original, got)
+func Test_nodeView_Search_NoAlloc(t *testing.T) {
+	n := node{slots: true}
+	for i := 0; i < 300; i++ {
+		n.entries = append(n.entries, entry{key: []byte{byte(i >> 8), byte(i)}, val: uint64(i)})
 	}
+	page, _ := n.MarshalBinary()
+
+	key := []byte{0, 200}
+	allocs := testing.AllocsPerRun(100, func() {
+		_, found, ref, err := nodeView(page).search(key)
+		if err != nil || !found || ref != 200 {
+			t.Fatalf("unexpected result: found=%t, ref=%d, err=%v", found, ref, err)
+		}
+	})
+	assert(t, allocs == 0, "expected no allocations, got %.1f", allocs)
 }
 
 func assert(t *testing.T, cond bool, msg string, args ...interface{}) {
@@ -1,6 +1,11 @@
 package bptree
 
-import "os"
+import (
+	"os"
+	"time"
+
+	"github.com/spy16/kiwi/pager"
+)
 
 // defaultOptions to be used by New().
 var defaultOptions = Options{
@@ -34,4 +39,45 @@ type Options struct {
 	// index is initialized. This helps avoid mmap/unmap and truncate
 	// overheads during insertions.
 	PreAlloc int
+
+	// FlushPolicy decides when the dirty nodes are written to the pager.
+	// Defaults to FlushOnPut.
+	FlushPolicy FlushPolicy
+
+	// MaxDirtyNodes is the number of dirty nodes at which a deferred
+	// flush is triggered automatically. Applies only to FlushDeferred.
+	// If zero, nodes are written only on Flush() or Close().
+	MaxDirtyNodes int
+
+	// SyncMode decides when the writes are synced to stable storage.
+	// Defaults to pager.SyncNone which leaves write-back to the OS.
+	SyncMode pager.SyncMode
+
+	// SyncInterval is the interval between background syncs. Applies
+	// only when SyncMode is pager.SyncPeriodic and must be positive.
+	SyncInterval time.Duration
+
+	// LockTimeout is the maximum time to wait for the lock on the index
+	// file held by another process. Open() fails with pager.ErrLocked if
+	// the lock could not be acquired. If 0, fails immediately.
+	LockTimeout time.Duration
+
+	// IOMode selects how the index file is accessed. Defaults to
+	// pager.IOMmap.
+	IOMode pager.IOMode
 }
+
+// FlushPolicy decides when the dirty nodes in the node cache are written to
+// the underlying pager.
+type FlushPolicy int
+
+// Flush policies supported.
+const (
+	// FlushOnPut writes all dirty nodes at the end of every Put().
+	FlushOnPut FlushPolicy = iota
+
+	// FlushDeferred keeps dirty nodes in the cache until Flush(), Close()
+	// or until the number of dirty nodes reaches MaxDirtyNodes. Repeated
+	// updates to the same node cost one page write per flush.
+	FlushDeferred
+)
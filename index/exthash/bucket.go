@@ -0,0 +1,118 @@
+package exthash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const (
+	// bucketLayout is the version of the bucket page layout.
+	bucketLayout = uint8(0x1)
+
+	bucketHeaderSz = 8
+	entryHeaderSz  = 18 // hash, value and key size
+)
+
+// bucket represents a bucket page. Entries are stored with their keys, so
+// the number of entries a bucket can hold depends on the key sizes. Bucket
+// pages are encoded in little-endian byte order as below:
+//
+//	layout   (1 byte)  - bucket page layout version
+//	depth    (1 byte)  - local depth of the bucket
+//	reserved (2 bytes)
+//	count    (4 bytes) - number of entries
+//	hash1    (8 bytes) - hash of the first key
+//	value1   (8 bytes) - value associated with the first key
+//	key1Sz   (2 bytes) - size of the first key
+//	key1     (variable)
+//	...
+type bucket struct {
+	id      int
+	depth   uint8
+	entries []entry
+}
+
+// size returns the number of bytes required to encode the bucket.
+func (b bucket) size() int {
+	sz := bucketHeaderSz
+	for _, e := range b.entries {
+		sz += entryHeaderSz + len(e.key)
+	}
+	return sz
+}
+
+// search returns the index of the entry with the given key.
+func (b bucket) search(key []byte, hash uint64) (int, bool) {
+	for i, e := range b.entries {
+		if e.hash == hash && bytes.Equal(e.key, key) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (b bucket) MarshalBinary() ([]byte, error) {
+	d := make([]byte, b.size())
+	d[0] = bucketLayout
+	d[1] = b.depth
+	bin.PutUint32(d[4:8], uint32(len(b.entries)))
+
+	offset := bucketHeaderSz
+	for _, e := range b.entries {
+		bin.PutUint64(d[offset:offset+8], e.hash)
+		bin.PutUint64(d[offset+8:offset+16], e.val)
+		bin.PutUint16(d[offset+16:offset+18], uint16(len(e.key)))
+		offset += entryHeaderSz
+
+		copy(d[offset:], e.key)
+		offset += len(e.key)
+	}
+
+	return d, nil
+}
+
+func (b *bucket) UnmarshalBinary(d []byte) error {
+	if b == nil {
+		return errors.New("cannot unmarshal into nil bucket")
+	} else if len(d) < bucketHeaderSz {
+		return fmt.Errorf("need at-least %d bytes, got only %d", bucketHeaderSz, len(d))
+	} else if d[0] != bucketLayout {
+		return fmt.Errorf("unknown bucket page layout %#x", d[0])
+	}
+
+	b.depth = d[1]
+	count := int(bin.Uint32(d[4:8]))
+
+	b.entries = make([]entry, 0, count)
+	offset := bucketHeaderSz
+	for i := 0; i < count; i++ {
+		if offset+entryHeaderSz > len(d) {
+			return errors.New("bucket entries exceed page")
+		}
+
+		e := entry{
+			hash: bin.Uint64(d[offset : offset+8]),
+			val:  bin.Uint64(d[offset+8 : offset+16]),
+		}
+		keySz := int(bin.Uint16(d[offset+16 : offset+18]))
+		offset += entryHeaderSz
+
+		if offset+keySz > len(d) {
+			return errors.New("bucket entries exceed page")
+		}
+		e.key = make([]byte, keySz)
+		copy(e.key, d[offset:offset+keySz])
+		offset += keySz
+
+		b.entries = append(b.entries, e)
+	}
+
+	return nil
+}
+
+type entry struct {
+	hash uint64
+	key  []byte
+	val  uint64
+}
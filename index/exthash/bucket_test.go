@@ -0,0 +1,40 @@
+package exthash
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBucket_Marshal_Unmarshal(t *testing.T) {
+	b := bucket{
+		depth: 3,
+		entries: []entry{
+			{hash: 0xCAFE, key: []byte("hello"), val: 1},
+			{hash: 0xBEEF, key: []byte("world!"), val: 2},
+		},
+	}
+
+	d, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() unexpected error: %v", err)
+	} else if len(d) != b.size() {
+		t.Errorf("expected %d bytes, got %d", b.size(), len(d))
+	}
+
+	page := make([]byte, 512)
+	copy(page, d)
+
+	got := bucket{}
+	if err := got.UnmarshalBinary(page); err != nil {
+		t.Fatalf("UnmarshalBinary() unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(b, got) {
+		t.Errorf("expected %+v, got %+v", b, got)
+	}
+
+	page[0] = 0xFF
+	if err := got.UnmarshalBinary(page); err == nil {
+		t.Errorf("UnmarshalBinary() expected error for unknown layout")
+	}
+}
@@ -0,0 +1,379 @@
+// Package exthash implements an on-disk hash index using extendible hashing.
+// A directory of 2^depth bucket pointers is indexed by the low bits of the
+// key hash. A full bucket is split into two and the directory is doubled
+// only when the bucket is already at the global depth, so no overflow
+// chains are formed even under skewed growth.
+package exthash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/spy16/kiwi/index"
+	"github.com/spy16/kiwi/index/internal/pagedir"
+	"github.com/spy16/kiwi/pager"
+)
+
+// bin is the byte order used for all marshals/unmarshals.
+var bin = binary.LittleEndian
+
+// ErrDirectoryFull is returned when a bucket cannot be split further since
+// the directory has reached the maximum depth. This happens only when too
+// many keys share the same hash bits.
+var ErrDirectoryFull = errors.New("directory reached maximum depth")
+
+// Open opens the file as extendible hash indexing file and returns the
+// indexer instance. If 'opts' is nil, uses default options.
+func Open(indexFile string, opts *Options) (*ExtHash, error) {
+	if opts == nil {
+		opts = &defaultOptions
+	}
+
+	pageSize := opts.PageSize
+	if pageSize != 0 && (pageSize < minPageSize || pageSize%minPageSize != 0) {
+		return nil, fmt.Errorf("invalid page size %d, must be a multiple of %d", pageSize, minPageSize)
+	}
+
+	// page size of an existing file is detected by the pager.
+	p, err := pager.Open(indexFile, &pager.Options{
+		ReadOnly:    opts.ReadOnly,
+		FileMode:    opts.FileMode,
+		PageSize:    pageSize,
+		LockTimeout: opts.LockTimeout,
+		IOMode:      opts.IOMode,
+		Owner:       pager.OwnerExtHash,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &ExtHash{
+		mu:       &sync.RWMutex{},
+		pager:    p,
+		pageSize: p.PageSize(),
+		readOnly: p.ReadOnly(),
+		dir:      pagedir.New(p),
+	}
+
+	// read header if index file is initialized, or initialize if
+	// the file is empty.
+	if err := idx.open(); err != nil {
+		_ = idx.Close()
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// ExtHash implements on-disk hashing based indexing using Extendible Hashing
+// algorithm.
+type ExtHash struct {
+	mu       *sync.RWMutex
+	pager    *pager.Pager
+	readOnly bool
+	pageSize int
+	header   header
+	dir      *pagedir.Dir // bucket page ids indexed by the low hash bits
+}
+
+// Get finds the index entry for given key in the hash table and returns. If
+// not entry found, returns ErrKeyNotFound.
+func (idx *ExtHash) Get(key []byte) (uint64, error) {
+	if len(key) == 0 {
+		return 0, index.ErrEmptyKey
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if idx.pager == nil {
+		return 0, os.ErrClosed
+	}
+
+	hash := idx.hash(key)
+	b, err := idx.readBucket(idx.bucketIndex(hash))
+	if err != nil {
+		return 0, err
+	}
+
+	i, found := b.search(key, hash)
+	if !found {
+		return 0, index.ErrKeyNotFound
+	}
+
+	return b.entries[i].val, nil
+}
+
+// Put inserts the indexing entry into the hash table. Keys must be small
+// enough for two entries to fit in a bucket page.
+func (idx *ExtHash) Put(key []byte, val uint64) error {
+	if len(key) == 0 {
+		return index.ErrEmptyKey
+	} else if len(key) > idx.maxKeySize() {
+		return index.ErrKeyTooLarge
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.isImmutable() {
+		return index.ErrImmutable
+	}
+
+	return idx.putEntry(entry{hash: idx.hash(key), key: key, val: val})
+}
+
+// Del removes the entry for the given key from the hash table and returns
+// the removed entry. Buckets are not merged when they become empty.
+func (idx *ExtHash) Del(key []byte) (uint64, error) {
+	if len(key) == 0 {
+		return 0, index.ErrEmptyKey
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.isImmutable() {
+		return 0, index.ErrImmutable
+	}
+
+	hash := idx.hash(key)
+	b, err := idx.readBucket(idx.bucketIndex(hash))
+	if err != nil {
+		return 0, err
+	}
+
+	i, found := b.search(key, hash)
+	if !found {
+		return 0, index.ErrKeyNotFound
+	}
+
+	val := b.entries[i].val
+	b.entries = append(b.entries[:i], b.entries[i+1:]...)
+	if err := idx.pager.Marshal(b.id, b); err != nil {
+		return 0, err
+	}
+
+	idx.header.count--
+	return val, idx.writeHeader()
+}
+
+// Size returns the number of entries in the index.
+func (idx *ExtHash) Size() int64 { return int64(idx.header.count) }
+
+// Sync flushes the pages written so far to stable storage.
+func (idx *ExtHash) Sync() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.pager == nil {
+		return os.ErrClosed
+	}
+	return idx.pager.Sync()
+}
+
+// Close flushes any pending writes and frees the file descriptor.
+func (idx *ExtHash) Close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.pager == nil {
+		return nil
+	}
+
+	err := idx.pager.Close()
+	idx.pager = nil
+	return err
+}
+
+func (idx *ExtHash) String() string {
+	return fmt.Sprintf(
+		"ExtHash{pager='%s', closed=%t, size=%d, depth=%d}",
+		idx.pager, idx.pager == nil, idx.header.count, idx.header.depth,
+	)
+}
+
+func (idx *ExtHash) putEntry(e entry) error {
+	for {
+		bucketIdx := idx.bucketIndex(e.hash)
+		b, err := idx.readBucket(bucketIdx)
+		if err != nil {
+			return err
+		}
+
+		if i, found := b.search(e.key, e.hash); found {
+			if b.entries[i].val == e.val {
+				return nil
+			}
+			b.entries[i].val = e.val
+			return idx.pager.Marshal(b.id, b)
+		}
+
+		if b.size()+entryHeaderSz+len(e.key) <= idx.pageSize {
+			b.entries = append(b.entries, e)
+			if err := idx.pager.Marshal(b.id, b); err != nil {
+				return err
+			}
+
+			idx.header.count++
+			return idx.writeHeader()
+		}
+
+		// bucket is full. split it and retry, the entry may still land in
+		// a full bucket if all entries share the next hash bit.
+		if err := idx.split(bucketIdx, b); err != nil {
+			return err
+		}
+	}
+}
+
+// split distributes the entries of the bucket between itself and a new
+// bucket based on the hash bit at the local depth. The directory is doubled
+// first if the bucket is already at the global depth.
+func (idx *ExtHash) split(bucketIdx int, b *bucket) error {
+	if uint32(b.depth) == idx.header.depth {
+		if idx.header.depth == maxGlobalDepth {
+			return ErrDirectoryFull
+		}
+
+		idx.dir.Double()
+		idx.header.depth++
+	}
+
+	bit := uint64(1) << b.depth
+	b.depth++
+
+	pid, err := idx.pager.Alloc(1)
+	if err != nil {
+		return err
+	}
+	sibling := &bucket{id: pid, depth: b.depth}
+
+	entries := b.entries
+	b.entries = nil
+	for _, e := range entries {
+		if e.hash&bit == 0 {
+			b.entries = append(b.entries, e)
+		} else {
+			sibling.entries = append(sibling.entries, e)
+		}
+	}
+
+	if err := idx.pager.Marshal(b.id, b); err != nil {
+		return err
+	} else if err := idx.pager.Marshal(sibling.id, sibling); err != nil {
+		return err
+	}
+
+	// all directory entries sharing the low bits of the old bucket with
+	// the split bit set now point to the sibling.
+	low := uint64(bucketIdx) & (bit - 1)
+	for i := low | bit; i < uint64(len(idx.dir.Entries)); i += bit << 1 {
+		idx.dir.Set(int(i), sibling.id)
+	}
+
+	if err := idx.dir.Flush(); err != nil {
+		return err
+	}
+
+	return idx.writeHeader()
+}
+
+func (idx *ExtHash) readBucket(bucketIdx int) (*bucket, error) {
+	b := &bucket{}
+	pid := idx.dir.Entries[bucketIdx]
+	if err := idx.pager.Unmarshal(pid, b); err != nil {
+		return nil, err
+	}
+	b.id = pid
+	return b, nil
+}
+
+func (idx *ExtHash) open() error {
+	if idx.pager.Count() == 0 {
+		// empty file, so initialize it
+		return idx.init()
+	}
+
+	h := header{}
+	if err := idx.pager.Unmarshal(0, &h); err != nil {
+		return err
+	}
+
+	if err := h.Validate(); err != nil {
+		return err
+	} else if int(h.pageSz) != idx.pageSize {
+		return fmt.Errorf("page size in header (%d) does not match pager (%d)", h.pageSz, idx.pageSize)
+	}
+	idx.header = h
+
+	return idx.dir.Load(int(h.dirPage), 1<<h.depth)
+}
+
+func (idx *ExtHash) init() error {
+	if idx.isImmutable() {
+		return index.ErrImmutable
+	}
+
+	// page 0 for the header, page 1 for the first directory page and
+	// page 2 for the first bucket.
+	_, err := idx.pager.Alloc(3)
+	if err != nil {
+		return err
+	}
+
+	seed, err := index.NewSeed()
+	if err != nil {
+		return err
+	}
+
+	idx.header = header{
+		magic:   magic,
+		version: version,
+		pageSz:  uint32(idx.pageSize),
+		dirPage: 1,
+		hashAlg: hashXXH64,
+		seed:    seed,
+	}
+
+	if err := idx.pager.Marshal(2, bucket{id: 2}); err != nil {
+		return err
+	}
+
+	idx.dir.Init(1)
+	idx.dir.Append(2)
+	if err := idx.dir.Flush(); err != nil {
+		return err
+	}
+
+	return idx.writeHeader()
+}
+
+func (idx *ExtHash) writeHeader() error {
+	return idx.pager.Marshal(0, idx.header)
+}
+
+// maxKeySize returns the size of the largest key allowed. At-least two
+// entries must fit in a bucket so that splitting can make room.
+func (idx *ExtHash) maxKeySize() int {
+	sz := (idx.pageSize-bucketHeaderSz)/2 - entryHeaderSz
+	if sz > 0xFFFF {
+		sz = 0xFFFF
+	}
+	return sz
+}
+
+func (idx *ExtHash) hash(key []byte) uint64 {
+	return index.XXH64(key, idx.header.seed)
+}
+
+func (idx *ExtHash) bucketIndex(hash uint64) int {
+	return int(hash & (1<<idx.header.depth - 1))
+}
+
+func (idx *ExtHash) isImmutable() bool {
+	return idx.readOnly || idx.pager == nil
+}
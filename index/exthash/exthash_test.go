@@ -0,0 +1,212 @@
+package exthash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spy16/kiwi/index"
+)
+
+func TestExtHash_Put_Get(t *testing.T) {
+	idx, err := Open(":memory:", &Options{PageSize: 512})
+	if err != nil {
+		t.Fatalf("failed to init extendible hash: %v", err)
+	}
+	defer idx.Close()
+
+	count := 10000
+	writeLot(t, idx, count)
+	if idx.Size() != int64(count) {
+		t.Errorf("expected size to be %d, not %d", count, idx.Size())
+	}
+
+	if idx.header.depth == 0 {
+		t.Errorf("expected directory to be doubled, got depth %d", idx.header.depth)
+	}
+	readCheck(t, idx, count)
+
+	// overwrite existing entry.
+	if err := idx.Put(genKey(10), 1000); err != nil {
+		t.Fatalf("Put() unexpected error: %v", err)
+	}
+	if v, err := idx.Get(genKey(10)); err != nil || v != 1000 {
+		t.Errorf("Get() expected 1000, got %d (err=%v)", v, err)
+	}
+	if idx.Size() != int64(count) {
+		t.Errorf("expected size to be %d after overwrite, not %d", count, idx.Size())
+	}
+
+	if _, err := idx.Get(genKey(count + 1)); err != index.ErrKeyNotFound {
+		t.Errorf("Get() expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestExtHash_Directory(t *testing.T) {
+	idx, err := Open(":memory:", &Options{PageSize: 512})
+	if err != nil {
+		t.Fatalf("failed to init extendible hash: %v", err)
+	}
+	defer idx.Close()
+
+	writeLot(t, idx, 5000)
+
+	// every bucket with local depth 'd' must be referenced by exactly the
+	// directory entries sharing its low 'd' bits.
+	for i, pid := range idx.dir.Entries {
+		b, err := idx.readBucket(i)
+		if err != nil {
+			t.Fatalf("readBucket(%d) unexpected error: %v", i, err)
+		}
+
+		if uint32(b.depth) > idx.header.depth {
+			t.Fatalf("bucket %d has local depth %d > global %d", pid, b.depth, idx.header.depth)
+		}
+
+		mask := 1<<b.depth - 1
+		for j, other := range idx.dir.Entries {
+			if (j&mask == i&mask) != (other == pid) {
+				t.Fatalf("directory entry %d is inconsistent with bucket at %d", j, i)
+			}
+		}
+
+		for _, e := range b.entries {
+			if int(e.hash)&mask != i&mask {
+				t.Fatalf("entry with hash %x misplaced in bucket %d", e.hash, pid)
+			}
+		}
+	}
+}
+
+func TestExtHash_Del(t *testing.T) {
+	idx, err := Open(":memory:", &Options{PageSize: 512})
+	if err != nil {
+		t.Fatalf("failed to init extendible hash: %v", err)
+	}
+	defer idx.Close()
+
+	count := 2000
+	writeLot(t, idx, count)
+
+	for i := 0; i < count; i += 2 {
+		v, err := idx.Del(genKey(i))
+		if err != nil {
+			t.Fatalf("Del() unexpected error: %v", err)
+		} else if v != uint64(i) {
+			t.Fatalf("Del() expected %d, got %d", i, v)
+		}
+	}
+
+	if idx.Size() != int64(count/2) {
+		t.Errorf("expected size to be %d, not %d", count/2, idx.Size())
+	}
+
+	for i := 0; i < count; i++ {
+		_, err := idx.Get(genKey(i))
+		if i%2 == 0 && err != index.ErrKeyNotFound {
+			t.Fatalf("Get() expected ErrKeyNotFound for deleted key %d, got %v", i, err)
+		} else if i%2 == 1 && err != nil {
+			t.Fatalf("Get() unexpected error for key %d: %v", i, err)
+		}
+	}
+
+	if _, err := idx.Del(genKey(0)); err != index.ErrKeyNotFound {
+		t.Errorf("Del() expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestExtHash_LongKeys(t *testing.T) {
+	idx, err := Open(":memory:", &Options{PageSize: 512})
+	if err != nil {
+		t.Fatalf("failed to init extendible hash: %v", err)
+	}
+	defer idx.Close()
+
+	for i := 0; i < 500; i++ {
+		key := bytes.Repeat(genKey(i), 50)
+		if err := idx.Put(key, uint64(i)); err != nil {
+			t.Fatalf("Put() unexpected error: %v", err)
+		}
+	}
+
+	for i := 0; i < 500; i++ {
+		key := bytes.Repeat(genKey(i), 50)
+		if v, err := idx.Get(key); err != nil || v != uint64(i) {
+			t.Fatalf("Get() expected %d, got %d (err=%v)", i, v, err)
+		}
+	}
+
+	if err := idx.Put(make([]byte, idx.maxKeySize()+1), 1); err != index.ErrKeyTooLarge {
+		t.Errorf("Put() expected ErrKeyTooLarge, got %v", err)
+	}
+}
+
+func TestExtHash_Reopen(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "exthash.idx")
+
+	idx, err := Open(fileName, &Options{FileMode: 0644, PageSize: 1024})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+
+	count := 5000
+	writeLot(t, idx, count)
+	depth := idx.header.depth
+	if err := idx.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	if _, err := Open(fileName, &Options{PageSize: 4096}); err == nil {
+		t.Errorf("Open() expected error for mismatched page size")
+	}
+
+	idx, err = Open(fileName, &Options{ReadOnly: true, PageSize: 1024})
+	if err != nil {
+		t.Fatalf("Open() unexpected error on reopen: %v", err)
+	}
+	defer idx.Close()
+
+	if idx.header.depth != depth || idx.Size() != int64(count) {
+		t.Errorf("unexpected state after reopen: %s", idx)
+	}
+	readCheck(t, idx, count)
+
+	if err := idx.Put(genKey(1), 1); err != index.ErrImmutable {
+		t.Errorf("Put() expected ErrImmutable, got %v", err)
+	}
+}
+
+func readCheck(t *testing.T, idx *ExtHash, count int) {
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		key := genKey(i)
+
+		v, err := idx.Get(key)
+		if err != nil {
+			t.Fatalf("Get('%x') unexpected error: %#v", key, err)
+		}
+
+		if v != uint64(i) {
+			t.Fatalf("Get('%x'): %d != %d", key, v, i)
+		}
+	}
+	t.Logf("read %d keys in %s", count, time.Since(start))
+}
+
+func writeLot(t *testing.T, idx *ExtHash, count int) {
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		if err := idx.Put(genKey(i), uint64(i)); err != nil {
+			t.Fatalf("Put() unexpected error: %v", err)
+		}
+	}
+	t.Logf("inserted %d keys in %s", count, time.Since(start))
+}
+
+func genKey(i int) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(i))
+	return b[:]
+}
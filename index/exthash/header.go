@@ -0,0 +1,104 @@
+package exthash
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// magic marker to indicate extendible hash index.
+	// hex version of 'exth'
+	magic   = uint32(0x65787468)
+	version = uint8(0x1)
+
+	// hashXXH64 is the id of the seeded xxHash64 algorithm.
+	hashXXH64 = uint32(1)
+
+	// maxGlobalDepth limits the directory to 2^24 entries.
+	maxGlobalDepth = 24
+
+	headerSz = 40
+)
+
+// header stores the information about the extendible hash instance in the
+// file. Header is stored in page 0 with all fields encoded in little-endian
+// byte order.
+//
+//	magic    (4 bytes) - magic marker 'exth'
+//	version  (1 byte)  - version of the file layout
+//	flags    (1 byte)  - control flags
+//	reserved (2 bytes)
+//	pageSz   (4 bytes) - page size used to create the file
+//	depth    (4 bytes) - global depth of the directory
+//	count    (8 bytes) - number of entries
+//	dirPage  (4 bytes) - first directory page
+//	hashAlg  (4 bytes) - hash algorithm id
+//	seed     (8 bytes) - hash seed
+type header struct {
+	magic   uint32 // magic marker to indicate extendible hash index file
+	version uint8  // version of the file layout
+	flags   uint8  // control flags
+	pageSz  uint32 // page size the index file was created with
+	depth   uint32 // global depth i.e., directory has 2^depth entries
+	count   uint64 // number of entries in the index
+	dirPage uint32 // id of the first directory page
+	hashAlg uint32 // id of the hash algorithm used for keys
+	seed    uint64 // seed for the hash algorithm
+}
+
+func (h header) Validate() error {
+	if h.magic != magic {
+		return errors.New("invalid magic in header, not an extendible hash file")
+	}
+
+	if h.version != version {
+		return fmt.Errorf("incompatible version %#x (expected: %#x)", h.version, version)
+	}
+
+	if h.pageSz < minPageSize {
+		return errors.New("invalid page size in header")
+	}
+
+	if h.hashAlg != hashXXH64 {
+		return fmt.Errorf("unsupported hash algorithm %d in header", h.hashAlg)
+	}
+
+	if h.depth > maxGlobalDepth {
+		return errors.New("global depth out of range in header")
+	}
+
+	return nil
+}
+
+func (h header) MarshalBinary() ([]byte, error) {
+	d := make([]byte, headerSz)
+	bin.PutUint32(d[0:4], h.magic)
+	d[4] = h.version
+	d[5] = h.flags
+	bin.PutUint32(d[8:12], h.pageSz)
+	bin.PutUint32(d[12:16], h.depth)
+	bin.PutUint64(d[16:24], h.count)
+	bin.PutUint32(d[24:28], h.dirPage)
+	bin.PutUint32(d[28:32], h.hashAlg)
+	bin.PutUint64(d[32:40], h.seed)
+	return d, nil
+}
+
+func (h *header) UnmarshalBinary(d []byte) error {
+	if h == nil {
+		return errors.New("cannot unmarshal into nil header")
+	} else if len(d) < headerSz {
+		return fmt.Errorf("need at-least %d bytes, got only %d", headerSz, len(d))
+	}
+
+	h.magic = bin.Uint32(d[0:4])
+	h.version = d[4]
+	h.flags = d[5]
+	h.pageSz = bin.Uint32(d[8:12])
+	h.depth = bin.Uint32(d[12:16])
+	h.count = bin.Uint64(d[16:24])
+	h.dirPage = bin.Uint32(d[24:28])
+	h.hashAlg = bin.Uint32(d[28:32])
+	h.seed = bin.Uint64(d[32:40])
+	return nil
+}
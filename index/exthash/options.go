@@ -0,0 +1,36 @@
+package exthash
+
+import (
+	"os"
+	"time"
+
+	"github.com/spy16/kiwi/pager"
+)
+
+// minPageSize is the smallest page size allowed.
+const minPageSize = 512
+
+var defaultOptions = Options{
+	ReadOnly: false,
+	FileMode: os.ModePerm,
+}
+
+// Options can be provided to Open() to configure initialization.
+type Options struct {
+	ReadOnly bool
+	FileMode os.FileMode
+
+	// PageSize to be used for file I/O. Must be a multiple of 512 and
+	// must match the page size of an existing index file. Defaults to the
+	// page size of the existing file or os.Getpagesize() for new files.
+	PageSize int
+
+	// LockTimeout is the maximum time to wait for the lock on the index
+	// file held by another process. Open() fails with pager.ErrLocked if
+	// the lock could not be acquired. If 0, fails immediately.
+	LockTimeout time.Duration
+
+	// IOMode selects how the index file is accessed. Defaults to
+	// pager.IOMmap.
+	IOMode pager.IOMode
+}
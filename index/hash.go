@@ -0,0 +1,95 @@
+package index
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math/bits"
+)
+
+// NewSeed returns a random seed for the hash function of a new on-disk hash
+// index. Seed should be persisted along with the index.
+func NewSeed() (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b[:]), nil
+}
+
+const (
+	prime64_1 = 11400714785074694791
+	prime64_2 = 14029467366897019727
+	prime64_3 = 1609587929392839161
+	prime64_4 = 9650029242287828579
+	prime64_5 = 2870177450012600261
+)
+
+// XXH64 is an implementation of the xxHash64 algorithm. Output depends only
+// on the input and the seed and is stable across processes and platforms,
+// which makes it suitable for on-disk hash indexes.
+// See https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md
+func XXH64(d []byte, seed uint64) uint64 {
+	n := len(d)
+	var h uint64
+
+	if n >= 32 {
+		v1 := seed + prime64_1 + prime64_2
+		v2 := seed + prime64_2
+		v3 := seed
+		v4 := seed - prime64_1
+
+		for len(d) >= 32 {
+			v1 = xxhRound(v1, binary.LittleEndian.Uint64(d[0:8]))
+			v2 = xxhRound(v2, binary.LittleEndian.Uint64(d[8:16]))
+			v3 = xxhRound(v3, binary.LittleEndian.Uint64(d[16:24]))
+			v4 = xxhRound(v4, binary.LittleEndian.Uint64(d[24:32]))
+			d = d[32:]
+		}
+
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+			bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxhMerge(h, v1)
+		h = xxhMerge(h, v2)
+		h = xxhMerge(h, v3)
+		h = xxhMerge(h, v4)
+	} else {
+		h = seed + prime64_5
+	}
+
+	h += uint64(n)
+
+	for ; len(d) >= 8; d = d[8:] {
+		h ^= xxhRound(0, binary.LittleEndian.Uint64(d[0:8]))
+		h = bits.RotateLeft64(h, 27)*prime64_1 + prime64_4
+	}
+
+	if len(d) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(d[0:4])) * prime64_1
+		h = bits.RotateLeft64(h, 23)*prime64_2 + prime64_3
+		d = d[4:]
+	}
+
+	for ; len(d) > 0; d = d[1:] {
+		h ^= uint64(d[0]) * prime64_5
+		h = bits.RotateLeft64(h, 11) * prime64_1
+	}
+
+	h ^= h >> 33
+	h *= prime64_2
+	h ^= h >> 29
+	h *= prime64_3
+	h ^= h >> 32
+	return h
+}
+
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * prime64_2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * prime64_1
+}
+
+func xxhMerge(acc, val uint64) uint64 {
+	val = xxhRound(0, val)
+	acc ^= val
+	return acc*prime64_1 + prime64_4
+}
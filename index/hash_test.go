@@ -0,0 +1,33 @@
+package index_test
+
+import (
+	"testing"
+
+	"github.com/spy16/kiwi/index"
+)
+
+func Test_XXH64(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		input string
+		want  uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"as", 0x1c330fb2d66be179},
+		{"asd", 0x631c37ce72a97393},
+		{"asdf", 0x415872f599cea71e},
+		{"Call me Ishmael. Some years ago--never mind how long precisely-", 0x02a2e85470d6fd96},
+	}
+
+	for _, tt := range table {
+		if got := index.XXH64([]byte(tt.input), 0); got != tt.want {
+			t.Errorf("XXH64('%s') want=%#x got=%#x", tt.input, tt.want, got)
+		}
+	}
+
+	if index.XXH64([]byte("a"), 0) == index.XXH64([]byte("a"), 1) {
+		t.Errorf("XXH64() expected different hashes for different seeds")
+	}
+}
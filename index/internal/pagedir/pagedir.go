@@ -0,0 +1,187 @@
+// Package pagedir implements the page directory shared by the hash indexes.
+// A directory is a list of page ids stored in a chain of directory pages,
+// which is fully loaded into memory on open.
+package pagedir
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/spy16/kiwi/pager"
+)
+
+var bin = binary.LittleEndian
+
+// headerSz is the size of the directory page header which holds the id of
+// the next directory page.
+const headerSz = 4
+
+// Dir is a page directory. Entries are modified in memory and the dirty
+// directory pages are written by Flush().
+//
+// Directory page layout:
+//
+//	next    (4 bytes) - id of the next directory page (0 means none)
+//	entry0  (4 bytes) - page id
+//	entry1  (4 bytes) - page id
+//	...
+type Dir struct {
+	// Entries holds the page ids in the directory. Must be modified only
+	// using the methods of Dir.
+	Entries []int
+
+	p       *pager.Pager
+	pages   []int        // ids of the directory pages
+	perPage int          // number of entries per directory page
+	dirty   map[int]bool // indices of directory pages to be written
+}
+
+// New returns an empty directory on the pager.
+func New(p *pager.Pager) *Dir {
+	return &Dir{
+		p:       p,
+		perPage: (p.PageSize() - headerSz) / 4,
+		dirty:   map[int]bool{},
+	}
+}
+
+// Init resets the directory to an empty one starting at the given page,
+// which must already be allocated.
+func (dir *Dir) Init(firstPage int) {
+	dir.Entries = nil
+	dir.pages = []int{firstPage}
+	dir.dirty = map[int]bool{0: true}
+}
+
+// Load reads the directory page chain starting at the given page id until
+// 'count' entries are read.
+func (dir *Dir) Load(firstPage, count int) error {
+	dir.pages = nil
+	dir.Entries = make([]int, 0, count)
+	dir.dirty = map[int]bool{}
+
+	pid := firstPage
+	for len(dir.Entries) < count {
+		if pid == 0 {
+			return errors.New("page directory is truncated")
+		}
+
+		d, err := dir.p.Read(pid)
+		if err != nil {
+			return err
+		}
+		dir.pages = append(dir.pages, pid)
+
+		for i := 0; i < dir.perPage && len(dir.Entries) < count; i++ {
+			off := headerSz + i*4
+			dir.Entries = append(dir.Entries, int(bin.Uint32(d[off:off+4])))
+		}
+		pid = int(bin.Uint32(d[0:4]))
+	}
+
+	return nil
+}
+
+// Set updates the entry at the given index.
+func (dir *Dir) Set(i, pid int) {
+	dir.Entries[i] = pid
+	dir.dirty[i/dir.perPage] = true
+}
+
+// Append adds an entry to the end of the directory.
+func (dir *Dir) Append(pid int) {
+	dir.Entries = append(dir.Entries, pid)
+	dir.dirty[(len(dir.Entries)-1)/dir.perPage] = true
+}
+
+// Double doubles the number of entries. New entries are copies of the
+// entries in the lower half.
+func (dir *Dir) Double() {
+	n := len(dir.Entries)
+	dir.Entries = append(dir.Entries, dir.Entries...)
+	for pageIdx := n / dir.perPage; pageIdx*dir.perPage < len(dir.Entries); pageIdx++ {
+		dir.dirty[pageIdx] = true
+	}
+}
+
+// Truncate removes the entries from 'n' onwards and writes the directory.
+// Directory pages that are not required anymore are released to the free
+// list of the pager after they are unlinked from the chain.
+func (dir *Dir) Truncate(n int) error {
+	dir.Entries = dir.Entries[:n]
+
+	required := (n + dir.perPage - 1) / dir.perPage
+	if required == 0 {
+		required = 1
+	}
+
+	var released []int
+	if required < len(dir.pages) {
+		released = append(released, dir.pages[required:]...)
+		dir.pages = dir.pages[:required]
+		for pageIdx := range dir.dirty {
+			if pageIdx >= required {
+				delete(dir.dirty, pageIdx)
+			}
+		}
+		dir.dirty[required-1] = true
+	}
+
+	if err := dir.Flush(); err != nil {
+		return err
+	}
+
+	for _, pid := range released {
+		if err := dir.p.Free(pid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush allocates any directory pages required and writes the dirty
+// directory pages.
+func (dir *Dir) Flush() error {
+	required := (len(dir.Entries) + dir.perPage - 1) / dir.perPage
+	for len(dir.pages) < required {
+		pid, err := dir.p.Alloc(1)
+		if err != nil {
+			return err
+		}
+		dir.pages = append(dir.pages, pid)
+
+		// link the previous directory page to the new one.
+		dir.dirty[len(dir.pages)-2] = true
+	}
+
+	for pageIdx := range dir.dirty {
+		if err := dir.write(pageIdx); err != nil {
+			return err
+		}
+		delete(dir.dirty, pageIdx)
+	}
+
+	return nil
+}
+
+// write encodes and writes the directory page at the given index in the
+// chain.
+func (dir *Dir) write(pageIdx int) error {
+	d := make([]byte, dir.p.PageSize())
+	if pageIdx+1 < len(dir.pages) {
+		bin.PutUint32(d[0:4], uint32(dir.pages[pageIdx+1]))
+	}
+
+	start := pageIdx * dir.perPage
+	end := start + dir.perPage
+	if end > len(dir.Entries) {
+		end = len(dir.Entries)
+	}
+
+	for i, pid := range dir.Entries[start:end] {
+		off := headerSz + i*4
+		bin.PutUint32(d[off:off+4], uint32(pid))
+	}
+
+	return dir.p.Write(dir.pages[pageIdx], d)
+}
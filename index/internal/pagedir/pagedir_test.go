@@ -0,0 +1,62 @@
+package pagedir
+
+import (
+	"testing"
+
+	"github.com/spy16/kiwi/pager"
+)
+
+func TestDir(t *testing.T) {
+	p, err := pager.Open(pager.InMemoryFileName, &pager.Options{PageSize: 512})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer p.Close()
+
+	// page 0 is never a directory page since 0 terminates the chain.
+	first, err := p.Alloc(2)
+	if err != nil {
+		t.Fatalf("Alloc() unexpected error: %v", err)
+	}
+	first++
+
+	// 127 entries fit in a 512 byte page, so the chain has 3 pages.
+	dir := New(p)
+	dir.Init(first)
+	for i := 0; i < 300; i++ {
+		dir.Append(1000 + i)
+	}
+	dir.Set(5, 42)
+	if err := dir.Flush(); err != nil {
+		t.Fatalf("Flush() unexpected error: %v", err)
+	}
+
+	loaded := New(p)
+	if err := loaded.Load(first, 300); err != nil {
+		t.Fatalf("Load() unexpected error: %v", err)
+	}
+	for i, pid := range loaded.Entries {
+		want := 1000 + i
+		if i == 5 {
+			want = 42
+		}
+		if pid != want {
+			t.Fatalf("entry %d: expected %d, got %d", i, want, pid)
+		}
+	}
+
+	before := p.Stats()
+	if err := loaded.Truncate(10); err != nil {
+		t.Fatalf("Truncate() unexpected error: %v", err)
+	}
+	if frees := p.Stats().Sub(before).Frees; frees != 2 {
+		t.Errorf("expected 2 directory pages to be freed, got %d", frees)
+	}
+
+	if err := New(p).Load(first, 300); err == nil {
+		t.Errorf("Load() expected error for truncated directory")
+	}
+	if err := New(p).Load(first, 10); err != nil {
+		t.Errorf("Load() unexpected error after Truncate: %v", err)
+	}
+}
@@ -3,16 +3,54 @@ package linearhash
 import (
 	"errors"
 	"fmt"
-	"unsafe"
 )
 
-const bucketSz = int(unsafe.Sizeof(bucket{}))
+const (
+	// bucketLayout is the version of the bucket page layout. It is stored
+	// in every bucket page to detect reading a page that is not a bucket.
+	bucketLayout = uint8(0x1)
 
-type bucket struct {
+	bucketHeaderSz = 20
+	slotSz         = 40
+
+	// inlineKeySz is the maximum size of keys stored inline in the slot.
+	// Larger keys are stored in key heap pages and the slot stores a
+	// reference to it.
+	inlineKeySz = 16
+)
+
+// bucketHeader is the fixed size header at the beginning of every bucket
+// page. A bucket page is encoded in little-endian byte order as below:
+//
+//	layout   (1 byte)  - bucket page layout version
+//	reserved (3 bytes)
+//	id       (4 bytes) - id of the bucket page
+//	overflow (4 bytes) - id of the overflow bucket page
+//	flags    (4 bytes) - control flags
+//	count    (4 bytes) - number of slots in use
+//	slot0    (40 bytes)
+//	slot1    (40 bytes)
+//	...
+//
+// Each slot is encoded as below:
+//
+//	hash     (8 bytes)  - hash of the key
+//	blobID   (8 bytes)  - value associated with the key
+//	keySz    (4 bytes)  - size of the key
+//	checksum (4 bytes)  - checksum of the key
+//	key      (16 bytes) - key itself or the key heap reference
+type bucketHeader struct {
 	id       uint32 // id of this bucket
 	overflow uint32 // overflow bucket id. (0 means no overflow)
 	flags    uint32 // control flags
-	ptr      uint32 // dummy pointer to slots
+	count    uint32 // number of slots in use
+}
+
+// bucket represents a primary or an overflow bucket page. Slots in a bucket
+// are always packed i.e., slots[0:count] are in use.
+type bucket struct {
+	bucketHeader
+	slots []slot
 }
 
 func (b bucket) next(idx *LinearHash) (*bucket, error) {
@@ -29,30 +67,100 @@ func (b bucket) next(idx *LinearHash) (*bucket, error) {
 }
 
 func (b *bucket) slot(id int) *slot {
-	slots := (*[0xFFFF]slot)(unsafe.Pointer(&b.ptr))
-	return &(slots)[id]
+	return &b.slots[id]
 }
 
 func (b bucket) MarshalBinary() ([]byte, error) {
-	mem := (*[0xFFFF]byte)(unsafe.Pointer(&b))
-	return append([]byte(nil), (*mem)[0:bucketSz]...), nil
+	if int(b.count) > len(b.slots) {
+		return nil, fmt.Errorf("slot count %d exceeds slots %d", b.count, len(b.slots))
+	}
+
+	d := make([]byte, bucketHeaderSz+int(b.count)*slotSz)
+	d[0] = bucketLayout
+	bin.PutUint32(d[4:8], b.id)
+	bin.PutUint32(d[8:12], b.overflow)
+	bin.PutUint32(d[12:16], b.flags)
+	bin.PutUint32(d[16:20], b.count)
+
+	offset := bucketHeaderSz
+	for i := 0; i < int(b.count); i++ {
+		b.slots[i].encode(d[offset : offset+slotSz])
+		offset += slotSz
+	}
+
+	return d, nil
 }
 
 func (b *bucket) UnmarshalBinary(d []byte) error {
 	if b == nil {
 		return errors.New("cannot unamarshal into nil slot")
-	} else if len(d) < bucketSz {
-		return fmt.Errorf("need at-least %d bytes, got only %d", bucketSz, len(d))
+	} else if len(d) < bucketHeaderSz {
+		return fmt.Errorf("need at-least %d bytes, got only %d", bucketHeaderSz, len(d))
+	} else if d[0] != bucketLayout {
+		return fmt.Errorf("unknown bucket page layout %#x", d[0])
+	}
+
+	b.id = bin.Uint32(d[4:8])
+	b.overflow = bin.Uint32(d[8:12])
+	b.flags = bin.Uint32(d[12:16])
+	b.count = bin.Uint32(d[16:20])
+
+	capacity := (len(d) - bucketHeaderSz) / slotSz
+	if int(b.count) > capacity {
+		return fmt.Errorf("slot count %d exceeds page capacity %d", b.count, capacity)
+	}
+
+	b.slots = make([]slot, capacity)
+	offset := bucketHeaderSz
+	for i := 0; i < int(b.count); i++ {
+		b.slots[i].decode(d[offset : offset+slotSz])
+		offset += slotSz
 	}
 
-	buckets := (*[0xFFFFF]bucket)(unsafe.Pointer(&d[0]))
-	*b = (*buckets)[0]
 	return nil
 }
 
+// slot represents a single entry in a bucket.
 type slot struct {
-	hash     uint64
-	blobID   uint64
-	keySz    uint32
-	checksum uint32
+	hash     uint64            // hash of the key
+	blobID   uint64            // value associated with the key
+	keySz    uint32            // size of the key
+	checksum uint32            // checksum of the key
+	key      [inlineKeySz]byte // the key itself or a key heap reference
+}
+
+func (sl slot) encode(d []byte) {
+	bin.PutUint64(d[0:8], sl.hash)
+	bin.PutUint64(d[8:16], sl.blobID)
+	bin.PutUint32(d[16:20], sl.keySz)
+	bin.PutUint32(d[20:24], sl.checksum)
+	copy(d[24:24+inlineKeySz], sl.key[:])
+}
+
+func (sl *slot) decode(d []byte) {
+	sl.hash = bin.Uint64(d[0:8])
+	sl.blobID = bin.Uint64(d[8:16])
+	sl.keySz = bin.Uint32(d[16:20])
+	sl.checksum = bin.Uint32(d[20:24])
+	copy(sl.key[:], d[24:24+inlineKeySz])
+}
+
+// mayMatch is a cheap pre-filter for key comparison. If it returns false,
+// the slot definitely does not belong to the key.
+func (sl slot) mayMatch(hash uint64, keySz int, checksum uint32) bool {
+	return sl.hash == hash && int(sl.keySz) == keySz && sl.checksum == checksum
+}
+
+// isInline returns true if the key is stored inline in the slot.
+func (sl slot) isInline() bool { return sl.keySz <= inlineKeySz }
+
+// keyRef returns the location of the key in the key heap. Valid only if
+// the key is not inline.
+func (sl slot) keyRef() (pageID, offset int) {
+	return int(bin.Uint32(sl.key[0:4])), int(bin.Uint32(sl.key[4:8]))
+}
+
+func (sl *slot) setKeyRef(pageID, offset int) {
+	bin.PutUint32(sl.key[0:4], uint32(pageID))
+	bin.PutUint32(sl.key[4:8], uint32(offset))
 }
@@ -7,10 +7,17 @@ import (
 
 func Test_bucket_binary(t *testing.T) {
 	original := bucket{
-		flags:    0xFF,
-		id:       123,
-		overflow: 456,
-		ptr:      789,
+		bucketHeader: bucketHeader{
+			flags:    0xFF,
+			id:       123,
+			overflow: 456,
+			count:    2,
+		},
+		slots: []slot{
+			{hash: 1, blobID: 10, keySz: 4, checksum: 0xAB, key: [inlineKeySz]byte{'k', 'e', 'y', '1'}},
+			{hash: 2, blobID: 20, keySz: 8, checksum: 0xCD},
+			{},
+		},
 	}
 
 	d, err := original.MarshalBinary()
@@ -18,8 +25,11 @@ func Test_bucket_binary(t *testing.T) {
 		t.Fatalf("MarshalBinary() unexpected error: %#v", err)
 	}
 
+	page := make([]byte, bucketHeaderSz+3*slotSz)
+	copy(page, d)
+
 	got := bucket{}
-	if err := got.UnmarshalBinary(d); err != nil {
+	if err := got.UnmarshalBinary(page); err != nil {
 		t.Errorf("UnmarshalBinary() unexpected error: %#v", err)
 	}
 
@@ -27,3 +37,16 @@ func Test_bucket_binary(t *testing.T) {
 		t.Errorf("want=%#v\ngot=%#v", original, got)
 	}
 }
+
+func Test_bucket_UnknownLayout(t *testing.T) {
+	page := make([]byte, 4096)
+	if err := (&bucket{}).UnmarshalBinary(page); err == nil {
+		t.Errorf("UnmarshalBinary() expected error for page without bucket layout")
+	}
+
+	page[0] = bucketLayout
+	bin.PutUint32(page[16:20], 0xFFFF)
+	if err := (&bucket{}).UnmarshalBinary(page); err == nil {
+		t.Errorf("UnmarshalBinary() expected error for slot count exceeding page")
+	}
+}
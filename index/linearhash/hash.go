@@ -0,0 +1,9 @@
+package linearhash
+
+// Hash algorithms supported. Algorithm id is stored in the header so that
+// the index file can be read with the same hash function on any machine.
+const (
+	hashXXH64 = uint32(1) // seeded xxHash64
+
+	defaultHashAlg = hashXXH64
+)
@@ -3,27 +3,61 @@ package linearhash
 import (
 	"errors"
 	"fmt"
-	"unsafe"
+	"math"
 )
 
 const (
 	// magic marker to indicate linear hash index.
 	// hex version of 'lhash'
 	magic   = uint32(0x6C686173)
-	version = uint8(0x1) // indexer version
+	version = uint8(0x2) // indexer version
 
-	headerSz = int(unsafe.Sizeof(header{}))
+	headerSz = 80
 )
 
 // header stores the information about the linear hash instance in the
-// file.
-// Note: Do not change the order of the fields.
+// file. Header is stored in page 0 with all fields encoded in little-endian
+// byte order.
+//
+//	magic    (4 bytes) - magic marker 'lhash'
+//	version  (1 byte)  - version of the file layout
+//	flags    (1 byte)  - control flags
+//	reserved (2 bytes)
+//	pageSz   (4 bytes) - page size used to create the file
+//	initial  (4 bytes) - number of buckets at level 0
+//	count    (8 bytes) - number of entries
+//	level    (4 bytes) - current level
+//	split    (4 bytes) - split pointer
+//	dirPage  (4 bytes) - first bucket directory page
+//	reserved (4 bytes)
+//	hashAlg  (4 bytes) - hash algorithm id
+//	keyPage  (4 bytes) - current key heap page
+//	seed     (8 bytes) - hash seed
+//	keyOff   (4 bytes) - free space offset in the key heap page
+//	reserved (4 bytes)
+//	maxLoad  (8 bytes) - load factor (float64) at which buckets are split
+//	minLoad  (8 bytes) - load factor (float64) below which buckets are merged
 type header struct {
-	magic   uint32 // magic marker to indicate linear hash index file
-	version uint8  // version of the linear hash indexer implementation
-	flags   uint8  // control flags
-	pageSz  uint16 // pageSize the index file was created with
-	ptr     uint64 // base pointer to the remaining data in the page
+	magic   uint32  // magic marker to indicate linear hash index file
+	version uint8   // version of the linear hash indexer implementation
+	flags   uint8   // control flags
+	pageSz  uint32  // pageSize the index file was created with
+	maxLoad float64 // load factor at which buckets are split
+	minLoad float64 // load factor below which buckets are merged (0=never)
+	count   uint64  // number of entries in the index
+	initial uint32  // number of buckets at level 0
+	level   uint32  // number of times the bucket count has doubled
+	split   uint32  // id of the next bucket to be split
+	dirPage uint32  // id of the first bucket directory page
+	hashAlg uint32  // id of the hash algorithm used for keys
+	seed    uint64  // seed for the hash algorithm
+	keyPage uint32  // id of the key heap page being filled (0 means none)
+	keyOff  uint32  // offset of the free space in the key heap page
+}
+
+// bucketCount returns the number of primary buckets in the index.
+func (h header) bucketCount() int {
+	return (int(h.initial) << h.level) + int(h.split)
 }
 
 func (h header) Validate() error {
@@ -35,16 +69,47 @@ func (h header) Validate() error {
 		return errors.New("invalid db version in header")
 	}
 
-	if h.pageSz == 0 {
-		return errors.New("page size not set in header")
+	if err := validatePageSize(int(h.pageSz)); err != nil {
+		return err
+	}
+
+	if err := validateLoadFactors(h.minLoad, h.maxLoad); err != nil {
+		return err
+	}
+
+	if h.hashAlg != hashXXH64 {
+		return fmt.Errorf("unsupported hash algorithm %d in header", h.hashAlg)
+	}
+
+	if h.initial == 0 {
+		return errors.New("initial bucket count not set in header")
+	}
+
+	if h.level >= 32 || h.split >= h.initial<<h.level {
+		return errors.New("split pointer out of range in header")
 	}
 
 	return nil
 }
 
 func (h header) MarshalBinary() ([]byte, error) {
-	mem := (*[0xFFFF]byte)(unsafe.Pointer(&h))
-	return append([]byte(nil), (*mem)[0:headerSz]...), nil
+	d := make([]byte, headerSz)
+	bin.PutUint32(d[0:4], h.magic)
+	d[4] = h.version
+	d[5] = h.flags
+	bin.PutUint32(d[8:12], h.pageSz)
+	bin.PutUint32(d[12:16], h.initial)
+	bin.PutUint64(d[16:24], h.count)
+	bin.PutUint32(d[24:28], h.level)
+	bin.PutUint32(d[28:32], h.split)
+	bin.PutUint32(d[32:36], h.dirPage)
+	bin.PutUint32(d[40:44], h.hashAlg)
+	bin.PutUint32(d[44:48], h.keyPage)
+	bin.PutUint64(d[48:56], h.seed)
+	bin.PutUint32(d[56:60], h.keyOff)
+	bin.PutUint64(d[64:72], math.Float64bits(h.maxLoad))
+	bin.PutUint64(d[72:80], math.Float64bits(h.minLoad))
+	return d, nil
 }
 
 func (h *header) UnmarshalBinary(d []byte) error {
@@ -54,7 +119,20 @@ func (h *header) UnmarshalBinary(d []byte) error {
 		return fmt.Errorf("need at-least %d bytes, got only %d", headerSz, len(d))
 	}
 
-	headers := (*[0xFFFFF]header)(unsafe.Pointer(&d[0]))
-	*h = (*headers)[0]
+	h.magic = bin.Uint32(d[0:4])
+	h.version = d[4]
+	h.flags = d[5]
+	h.pageSz = bin.Uint32(d[8:12])
+	h.initial = bin.Uint32(d[12:16])
+	h.count = bin.Uint64(d[16:24])
+	h.level = bin.Uint32(d[24:28])
+	h.split = bin.Uint32(d[28:32])
+	h.dirPage = bin.Uint32(d[32:36])
+	h.hashAlg = bin.Uint32(d[40:44])
+	h.keyPage = bin.Uint32(d[44:48])
+	h.seed = bin.Uint64(d[48:56])
+	h.keyOff = bin.Uint32(d[56:60])
+	h.maxLoad = math.Float64frombits(bin.Uint64(d[64:72]))
+	h.minLoad = math.Float64frombits(bin.Uint64(d[72:80]))
 	return nil
 }
@@ -1,6 +1,7 @@
 package linearhash
 
 import (
+	"bytes"
 	"encoding"
 	"testing"
 )
@@ -26,6 +27,17 @@ func Test_header(t *testing.T) {
 			magic:   magic,
 			version: version,
 			pageSz:  0x1000,
+			count:   100,
+			initial: 4,
+			level:   2,
+			split:   3,
+			dirPage: 1,
+			hashAlg: hashXXH64,
+			seed:    0xC0FFEE,
+			keyPage: 7,
+			keyOff:  100,
+			maxLoad: 0.75,
+			minLoad: 0.25,
 		}
 
 		data, err := original.MarshalBinary()
@@ -33,8 +45,13 @@ func Test_header(t *testing.T) {
 			t.Errorf("MarshalBinary() unexpected error: %#v", err)
 		}
 
-		if len(data) == 0 {
-			t.Errorf("byte conversion failed")
+		if len(data) != headerSz {
+			t.Errorf("byte conversion failed, expected %d bytes, got %d", headerSz, len(data))
+		}
+
+		// header must be encoded in little-endian irrespective of host.
+		if !bytes.Equal(data[0:4], []byte{0x73, 0x61, 0x68, 0x6C}) {
+			t.Errorf("expected magic in little-endian, got %#v", data[0:4])
 		}
 
 		got := header{}
@@ -0,0 +1,117 @@
+package linearhash
+
+import "os"
+
+// Each calls fn for every entry in the index by walking all the primary
+// and overflow buckets. Order of the entries is unspecified. Iteration
+// stops when fn returns true.
+func (idx *LinearHash) Each(fn func(key []byte, v uint64) bool) error {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if idx.pager == nil {
+		return os.ErrClosed
+	}
+
+	_, err := idx.walk(0, idx.header.bucketCount(), fn)
+	return err
+}
+
+// EachFrom is a resumable version of Each() which can be used to dump very
+// large tables incrementally. It visits the entries of at most maxBuckets
+// buckets starting at the cursor and returns the cursor to continue from.
+// Use 0 as the cursor to start the iteration. Returned cursor is 0 when the
+// iteration is complete.
+//
+// If fn returns true, iteration stops and the returned cursor points to the
+// current bucket. Entries present in the index for the entire iteration
+// are visited at least once even if the index is modified in-between the
+// calls. Entries may be visited more than once if fn stops the iteration
+// or buckets were split/merged in-between the calls.
+func (idx *LinearHash) EachFrom(cursor uint64, maxBuckets int, fn func(key []byte, v uint64) bool) (uint64, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if idx.pager == nil {
+		return 0, os.ErrClosed
+	}
+
+	start := idx.resumeAt(cursor)
+	end := idx.header.bucketCount()
+	if maxBuckets > 0 && start+maxBuckets < end {
+		end = start + maxBuckets
+	}
+
+	next, err := idx.walk(start, end, fn)
+	if err != nil {
+		return 0, err
+	} else if next >= idx.header.bucketCount() {
+		return 0, nil
+	}
+
+	return uint64(idx.header.bucketCount())<<32 | uint64(next), nil
+}
+
+// resumeAt returns the bucket to resume the iteration for the cursor. The
+// cursor holds the bucket to resume at (low 32 bits) and the number of
+// buckets when it was created (high 32 bits). Splits only move entries to
+// the buckets at the end of the table, but merges move entries from the
+// last buckets into their split images. So if the table shrunk, iteration
+// resumes at the lowest split image of the merged buckets.
+func (idx *LinearHash) resumeAt(cursor uint64) int {
+	bucket := int(uint32(cursor))
+	buckets := int(cursor >> 32)
+
+	for id := idx.header.bucketCount(); id < buckets; id++ {
+		if img := idx.splitImage(id); img < bucket {
+			bucket = img
+		}
+	}
+
+	return bucket
+}
+
+// splitImage returns the id of the bucket which was split to create the
+// bucket with given id.
+func (idx *LinearHash) splitImage(id int) int {
+	n := int(idx.header.initial)
+	for n*2 <= id {
+		n *= 2
+	}
+
+	if id < n {
+		return id
+	}
+	return id - n
+}
+
+// walk visits the entries of the buckets in range [start, end) and returns
+// the id of the bucket to continue from.
+func (idx *LinearHash) walk(start, end int, fn func(key []byte, v uint64) bool) (int, error) {
+	for id := start; id < end; id++ {
+		chain, err := idx.readChain(idx.dir.Entries[id])
+		if err != nil {
+			return 0, err
+		}
+
+		for _, b := range chain {
+			for i := 0; i < int(b.count); i++ {
+				sl := b.slot(i)
+
+				key := append([]byte(nil), sl.key[:]...)
+				if !sl.isInline() {
+					key, err = idx.readKey(*sl)
+					if err != nil {
+						return 0, err
+					}
+				}
+
+				if fn(key[:sl.keySz], sl.blobID) {
+					return id, nil
+				}
+			}
+		}
+	}
+
+	return end, nil
+}
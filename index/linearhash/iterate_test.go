@@ -0,0 +1,131 @@
+package linearhash
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestLinearHash_Each(t *testing.T) {
+	idx, err := Open(":memory:", nil)
+	if err != nil {
+		t.Fatalf("failed to init linear hash: %v", err)
+	}
+	defer idx.Close()
+
+	count := 5000
+	writeLot(t, idx, count)
+
+	seen := map[uint32]int{}
+	err = idx.Each(func(key []byte, v uint64) bool {
+		if binary.BigEndian.Uint32(key) != uint32(v) {
+			t.Fatalf("Each() key '%x' has unexpected value %d", key, v)
+		}
+		seen[uint32(v)]++
+		return false
+	})
+	if err != nil {
+		t.Fatalf("Each() unexpected error: %v", err)
+	}
+	assertSeen(t, seen, count, true)
+
+	visited := 0
+	_ = idx.Each(func(key []byte, v uint64) bool {
+		visited++
+		return visited == 10
+	})
+	if visited != 10 {
+		t.Errorf("Each() expected to stop after 10 entries, visited %d", visited)
+	}
+}
+
+func TestLinearHash_EachFrom(t *testing.T) {
+	idx, err := Open(":memory:", nil)
+	if err != nil {
+		t.Fatalf("failed to init linear hash: %v", err)
+	}
+	defer idx.Close()
+
+	count := 5000
+	writeLot(t, idx, count)
+
+	collect := func(seen map[uint32]int) func(key []byte, v uint64) bool {
+		return func(key []byte, v uint64) bool {
+			seen[uint32(v)]++
+			return false
+		}
+	}
+
+	t.Run("Unmodified", func(t *testing.T) {
+		seen := map[uint32]int{}
+		cursor, calls := uint64(0), 0
+		for {
+			cursor, err = idx.EachFrom(cursor, 3, collect(seen))
+			if err != nil {
+				t.Fatalf("EachFrom() unexpected error: %v", err)
+			}
+			calls++
+			if cursor == 0 {
+				break
+			}
+		}
+
+		if calls < 2 {
+			t.Errorf("expected iteration to take multiple calls, took %d", calls)
+		}
+		assertSeen(t, seen, count, true)
+	})
+
+	t.Run("Resized", func(t *testing.T) {
+		extra := 20000
+		seen := map[uint32]int{}
+		cursor, calls, maxBuckets := uint64(0), 0, 0
+		for {
+			cursor, err = idx.EachFrom(cursor, 2, collect(seen))
+			if err != nil {
+				t.Fatalf("EachFrom() unexpected error: %v", err)
+			}
+			calls++
+			if cursor == 0 {
+				break
+			}
+
+			// grow the table during the first few calls and shrink it
+			// afterwards to cause both splits and merges in-between.
+			if calls <= 2 {
+				from := count + (calls-1)*extra/2
+				for i := from; i < from+extra/2; i++ {
+					_ = idx.Put(genKey(i), uint64(i))
+				}
+			} else {
+				from := count + (calls-3)*2000
+				for i := from; i < from+2000 && i < count+extra; i++ {
+					_, _ = idx.Del(genKey(i))
+				}
+			}
+
+			if n := idx.header.bucketCount(); n > maxBuckets {
+				maxBuckets = n
+			}
+		}
+
+		if idx.header.bucketCount() >= maxBuckets {
+			t.Errorf("expected buckets to be merged during iteration")
+		}
+		assertSeen(t, seen, count, false)
+	})
+}
+
+// assertSeen verifies that all entries [0, count) were seen. If exact is
+// true, every entry must be seen exactly once.
+func assertSeen(t *testing.T, seen map[uint32]int, count int, exact bool) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		c := seen[uint32(i)]
+		if c == 0 {
+			t.Fatalf("entry %d was not visited", i)
+		} else if exact && c != 1 {
+			t.Fatalf("entry %d was visited %d times", i, c)
+		}
+	}
+}
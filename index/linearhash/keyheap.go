@@ -0,0 +1,148 @@
+package linearhash
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/spy16/kiwi/index"
+)
+
+// keyHeapHeaderSz is the size of the key heap page header which holds the
+// number of bytes used by the live keys in the page.
+const keyHeapHeaderSz = 4
+
+// Keys larger than inlineKeySz are appended to key heap pages. The header
+// tracks the heap page being filled and the offset of the free space in
+// it. A key is never split across pages, so the key size is bounded by the
+// page size. Slots refer to the keys using (page id, offset) and the key
+// size stored in the slot.
+//
+// Each heap page counts the bytes of the live keys in it. Deleting a key
+// decrements the count and the page is released to the free list once it
+// drops to 0, or reused from the start if it is the page being filled.
+//
+// Key heap page layout:
+//
+//	live    (4 bytes) - bytes used by the live keys in the page
+//	keys    (n bytes) - keys packed back to back
+
+// slotMatches returns true if the slot belongs to the given key. Checksum
+// and size are used as a pre-filter before comparing the full key.
+func (idx *LinearHash) slotMatches(sl slot, key []byte, hash uint64, checksum uint32) (bool, error) {
+	if !sl.mayMatch(hash, len(key), checksum) {
+		return false, nil
+	}
+
+	if sl.isInline() {
+		return bytes.Equal(sl.key[:sl.keySz], key), nil
+	}
+
+	stored, err := idx.readKey(sl)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(stored, key), nil
+}
+
+// newSlot creates a slot for the entry. If the key is too large to be
+// stored inline, it is written to the key heap.
+func (idx *LinearHash) newSlot(e entry, hash uint64) (slot, error) {
+	sl := slot{
+		hash:     hash,
+		blobID:   e.val,
+		keySz:    uint32(len(e.key)),
+		checksum: index.Checksum(e.key),
+	}
+
+	if sl.isInline() {
+		copy(sl.key[:], e.key)
+		return sl, nil
+	}
+
+	pageID, offset, err := idx.writeKey(e.key)
+	if err != nil {
+		return slot{}, err
+	}
+	sl.setKeyRef(pageID, offset)
+	return sl, nil
+}
+
+// readKey reads the key referred by the slot from the key heap.
+func (idx *LinearHash) readKey(sl slot) ([]byte, error) {
+	pageID, offset := sl.keyRef()
+
+	d, err := idx.pager.Read(pageID)
+	if err != nil {
+		return nil, err
+	}
+
+	end := offset + int(sl.keySz)
+	if end > len(d) {
+		return nil, fmt.Errorf("key heap reference (%d, %d) is out of bounds", pageID, offset)
+	}
+	return d[offset:end], nil
+}
+
+// writeKey appends the key to the key heap and returns its location. A new
+// heap page is allocated if the current one doesn't have enough space.
+func (idx *LinearHash) writeKey(key []byte) (pageID, offset int, err error) {
+	h := &idx.header
+
+	if h.keyPage == 0 || int(h.keyOff)+len(key) > idx.pageSize {
+		pid, err := idx.pager.Alloc(1)
+		if err != nil {
+			return 0, 0, err
+		}
+		h.keyPage = uint32(pid)
+		h.keyOff = keyHeapHeaderSz
+	}
+
+	d, err := idx.pager.Read(int(h.keyPage))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// pages returned by Alloc() are zeroed, so the live count of a new
+	// heap page starts at 0.
+	live := bin.Uint32(d[0:4])
+	bin.PutUint32(d[0:4], live+uint32(len(key)))
+
+	pageID, offset = int(h.keyPage), int(h.keyOff)
+	copy(d[offset:], key)
+	if err := idx.pager.Write(pageID, d); err != nil {
+		return 0, 0, err
+	}
+
+	h.keyOff += uint32(len(key))
+	return pageID, offset, nil
+}
+
+// freeKey releases the space used by the key referred by the slot in the
+// key heap. Nothing to do for inline keys.
+func (idx *LinearHash) freeKey(sl slot) error {
+	if sl.isInline() {
+		return nil
+	}
+	pageID, _ := sl.keyRef()
+
+	d, err := idx.pager.Read(pageID)
+	if err != nil {
+		return err
+	}
+
+	live := bin.Uint32(d[0:4])
+	if live < sl.keySz {
+		return fmt.Errorf("key heap page %d has %d live bytes, cannot free %d", pageID, live, sl.keySz)
+	}
+	live -= sl.keySz
+	bin.PutUint32(d[0:4], live)
+
+	h := &idx.header
+	if live > 0 || pageID == int(h.keyPage) {
+		if live == 0 {
+			h.keyOff = keyHeapHeaderSz
+		}
+		return idx.pager.Write(pageID, d)
+	}
+	return idx.pager.Free(pageID)
+}
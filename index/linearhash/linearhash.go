@@ -1,15 +1,23 @@
+// Package linearhash implements an on-disk hash index using the Litwin
+// linear hashing algorithm. Buckets are split one at a time in a round
+// robin fashion as the load factor grows, which keeps the cost of growth
+// incremental and point lookups O(1).
 package linearhash
 
 import (
+	"encoding/binary"
 	"fmt"
-	"hash/maphash"
 	"os"
 	"sync"
 
 	"github.com/spy16/kiwi/index"
+	"github.com/spy16/kiwi/index/internal/pagedir"
 	"github.com/spy16/kiwi/pager"
 )
 
+// bin is the byte order used for all marshals/unmarshals.
+var bin = binary.LittleEndian
+
 // Open opens the file as linear-hash indexing file and returns the indexer
 // instance. If 'opts' is nil, uses default options.
 func Open(indexFile string, opts *Options) (*LinearHash, error) {
@@ -17,7 +25,21 @@ func Open(indexFile string, opts *Options) (*LinearHash, error) {
 		opts = &defaultOptions
 	}
 
-	p, err := pager.Open(indexFile, os.Getpagesize(), opts.ReadOnly, opts.FileMode)
+	if opts.PageSize != 0 {
+		if err := validatePageSize(opts.PageSize); err != nil {
+			return nil, err
+		}
+	}
+
+	// page size of an existing file is detected by the pager.
+	p, err := pager.Open(indexFile, &pager.Options{
+		ReadOnly:    opts.ReadOnly,
+		FileMode:    opts.FileMode,
+		PageSize:    opts.PageSize,
+		LockTimeout: opts.LockTimeout,
+		IOMode:      opts.IOMode,
+		Owner:       pager.OwnerLinearHash,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -31,7 +53,7 @@ func Open(indexFile string, opts *Options) (*LinearHash, error) {
 
 	// read header if index file is initialized, or initialize if
 	// the file is empty.
-	if err := idx.open(); err != nil {
+	if err := idx.open(*opts); err != nil {
 		_ = idx.Close()
 		return nil, err
 	}
@@ -47,21 +69,36 @@ type LinearHash struct {
 	readOnly  bool
 	pageSize  int
 	slotCount int
+	header    header
+	dir       *pagedir.Dir // primary bucket page ids
 }
 
 // Get finds the index entry for given key in the hash table and returns. If
 // not entry found, returns ErrKeyNotFound.
 func (idx *LinearHash) Get(key []byte) (uint64, error) {
-	hash := idx.hash(key)
+	if len(key) == 0 {
+		return 0, index.ErrEmptyKey
+	}
 
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
 
-	return idx.getEntry(key, hash)
+	if idx.pager == nil {
+		return 0, os.ErrClosed
+	}
+
+	return idx.getEntry(key, idx.hash(key))
 }
 
-// Put inserts the indexing entry into the hash table.
+// Put inserts the indexing entry into the hash table. Keys must fit in a
+// key heap page, i.e., page size less the key heap page header.
 func (idx *LinearHash) Put(key []byte, val uint64) error {
+	if len(key) == 0 {
+		return index.ErrEmptyKey
+	} else if len(key) > idx.pageSize-keyHeapHeaderSz {
+		return index.ErrKeyTooLarge
+	}
+
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
@@ -75,6 +112,10 @@ func (idx *LinearHash) Put(key []byte, val uint64) error {
 // Del removes the entry for the given key from the hash table and returns
 // the removed entry.
 func (idx *LinearHash) Del(key []byte) (uint64, error) {
+	if len(key) == 0 {
+		return 0, index.ErrEmptyKey
+	}
+
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
 
@@ -82,7 +123,21 @@ func (idx *LinearHash) Del(key []byte) (uint64, error) {
 		return 0, index.ErrImmutable
 	}
 
-	return 0, index.ErrKeyNotFound
+	return idx.delEntry(key, idx.hash(key))
+}
+
+// Size returns the number of entries in the index.
+func (idx *LinearHash) Size() int64 { return int64(idx.header.count) }
+
+// Sync flushes the pages written so far to stable storage.
+func (idx *LinearHash) Sync() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.pager == nil {
+		return os.ErrClosed
+	}
+	return idx.pager.Sync()
 }
 
 // Close flushes any pending writes and frees the file descriptor.
@@ -101,56 +156,364 @@ func (idx *LinearHash) Close() error {
 
 func (idx *LinearHash) String() string {
 	return fmt.Sprintf(
-		"LinearHash{pager='%s', closed=%t}",
-		idx.pager, idx.pager == nil,
+		"LinearHash{pager='%s', closed=%t, size=%d, buckets=%d}",
+		idx.pager, idx.pager == nil, idx.header.count, idx.header.bucketCount(),
 	)
 }
 
 func (idx *LinearHash) getEntry(key []byte, hash uint64) (uint64, error) {
-	return 0, nil
+	b, slotID, found, err := idx.locateSlot(key, hash)
+	if err != nil {
+		return 0, err
+	} else if !found {
+		return 0, index.ErrKeyNotFound
+	}
+
+	return b.slot(slotID).blobID, nil
 }
 
 func (idx *LinearHash) putEntry(e entry) error {
-	return nil
+	hash := idx.hash(e.key)
+
+	b, slotID, found, err := idx.locateSlot(e.key, hash)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		sl := b.slot(slotID)
+		if sl.blobID == e.val {
+			return nil
+		}
+		sl.blobID = e.val
+		return idx.pager.Marshal(int(b.id), b)
+	}
+
+	// 'b' is the last bucket in the chain. allocate an overflow bucket
+	// if it is full.
+	if int(b.count) == idx.slotCount {
+		overflow, err := idx.allocBucket()
+		if err != nil {
+			return err
+		}
+
+		b.overflow = overflow.id
+		if err := idx.pager.Marshal(int(b.id), b); err != nil {
+			return err
+		}
+		b = overflow
+	}
+
+	sl, err := idx.newSlot(e, hash)
+	if err != nil {
+		return err
+	}
+
+	b.slots[b.count] = sl
+	b.count++
+	if err := idx.pager.Marshal(int(b.id), b); err != nil {
+		return err
+	}
+
+	idx.header.count++
+	if idx.loadFactor() > idx.header.maxLoad {
+		if err := idx.split(); err != nil {
+			return err
+		}
+	}
+
+	return idx.writeHeader()
+}
+
+// delEntry removes the slot for the given key by moving the last slot in
+// the chain into its place. This keeps the chain packed so that only the
+// last bucket in the chain can be partially filled.
+func (idx *LinearHash) delEntry(key []byte, hash uint64) (uint64, error) {
+	chain, err := idx.readChain(idx.dir.Entries[idx.bucketIndex(hash)])
+	if err != nil {
+		return 0, err
+	}
+
+	checksum := index.Checksum(key)
+	for _, b := range chain {
+		for i := 0; i < int(b.count); i++ {
+			match, err := idx.slotMatches(*b.slot(i), key, hash, checksum)
+			if err != nil {
+				return 0, err
+			} else if !match {
+				continue
+			}
+
+			sl := *b.slot(i)
+			if err := idx.removeSlot(chain, b, i); err != nil {
+				return 0, err
+			} else if err := idx.freeKey(sl); err != nil {
+				return 0, err
+			}
+
+			idx.header.count--
+			if idx.loadFactor() < idx.header.minLoad {
+				if err := idx.merge(); err != nil {
+					return 0, err
+				}
+			}
+
+			return sl.blobID, idx.writeHeader()
+		}
+	}
+
+	return 0, index.ErrKeyNotFound
 }
 
-func (idx *LinearHash) locateSlot(key []byte) (res *bucket, slotID int, err error) {
-	hash := idx.hash(key)
+// removeSlot fills the slot at index 'i' of bucket 'b' with the last slot
+// in the chain. If the last overflow bucket becomes empty, it is unlinked
+// and released to the free list.
+func (idx *LinearHash) removeSlot(chain []*bucket, b *bucket, i int) error {
+	tail := chain[len(chain)-1]
+	tail.count--
+	*b.slot(i) = tail.slots[tail.count]
+	tail.slots[tail.count] = slot{}
+
+	if b != tail {
+		if err := idx.pager.Marshal(int(b.id), b); err != nil {
+			return err
+		}
+	}
+
+	if tail.count > 0 || len(chain) == 1 {
+		return idx.pager.Marshal(int(tail.id), tail)
+	}
+
+	prev := chain[len(chain)-2]
+	prev.overflow = 0
+	if err := idx.pager.Marshal(int(prev.id), prev); err != nil {
+		return err
+	}
+	return idx.pager.Free(int(tail.id))
+}
+
+// locateSlot finds the slot for the given key. If the key is not found,
+// the last bucket in the chain is returned.
+func (idx *LinearHash) locateSlot(key []byte, hash uint64) (res *bucket, slotID int, found bool, err error) {
 	bucketID := idx.bucketIndex(hash)
 
-	bucketPage, err := idx.pager.Read(int(bucketID))
+	b := &bucket{}
+	if err := idx.pager.Unmarshal(idx.dir.Entries[bucketID], b); err != nil {
+		return nil, 0, false, err
+	}
+
+	checksum := index.Checksum(key)
+	for {
+		for i := 0; i < int(b.count); i++ {
+			match, err := idx.slotMatches(*b.slot(i), key, hash, checksum)
+			if err != nil {
+				return nil, 0, false, err
+			} else if match {
+				return b, i, true, nil
+			}
+		}
+
+		next, err := b.next(idx) // follow the bucket overflow pointer
+		if err != nil {
+			return nil, 0, false, err
+		} else if next == nil {
+			return b, 0, false, nil
+		}
+		b = next
+	}
+}
+
+// split splits the bucket at the split pointer by rehashing its entries
+// between itself and a new bucket at the end of the table and advances the
+// split pointer. Once all buckets of the current level are split, level is
+// incremented and split pointer is reset.
+func (idx *LinearHash) split() error {
+	h := &idx.header
+	n := uint64(h.initial) << h.level
+	oldID := int(h.split)
+
+	newBucket, err := idx.allocBucket()
 	if err != nil {
-		return nil, 0, err
+		return err
 	}
 
-	b := &bucket{}
-	if err := b.UnmarshalBinary(bucketPage); err != nil {
-		return nil, 0, err
+	idx.dir.Append(int(newBucket.id))
+	if err := idx.dir.Flush(); err != nil {
+		return err
 	}
 
-	for b != nil {
-		for i := 0; i < int(idx.slotCount); i++ {
-			sl := b.slot(i)
-			if sl.hash == 0 { // an empty slot
-				return b, i, nil
-			} else if sl.hash == hash {
-				return b, i, nil
+	chain, err := idx.readChain(idx.dir.Entries[oldID])
+	if err != nil {
+		return err
+	}
+
+	var keep, move []slot
+	for _, b := range chain {
+		for i := 0; i < int(b.count); i++ {
+			sl := b.slots[i]
+			if sl.hash%(2*n) == uint64(oldID) {
+				keep = append(keep, sl)
+			} else {
+				move = append(move, sl)
 			}
 		}
+	}
 
-		b, err = b.next(idx) // follow the bucket overflow pointer
+	if err := idx.writeChain(chain, keep); err != nil {
+		return err
+	}
+
+	if err := idx.writeChain([]*bucket{newBucket}, move); err != nil {
+		return err
+	}
+
+	h.split++
+	if uint64(h.split) == n {
+		h.level++
+		h.split = 0
+	}
+
+	return nil
+}
+
+// merge reverses the last split by moving the entries of the last bucket
+// into its split image and moving the split pointer back. All pages of the
+// last bucket are released to the free list. Index never shrinks below the
+// initial bucket count.
+func (idx *LinearHash) merge() error {
+	h := &idx.header
+	if h.bucketCount() <= int(h.initial) {
+		return nil
+	}
+
+	if h.split == 0 {
+		h.level--
+		h.split = h.initial << h.level
+	}
+	h.split--
+
+	srcID := h.bucketCount() // last bucket, after the split pointer moved back
+	dstID := int(h.split)
+
+	srcChain, err := idx.readChain(idx.dir.Entries[srcID])
+	if err != nil {
+		return err
+	}
+
+	dstChain, err := idx.readChain(idx.dir.Entries[dstID])
+	if err != nil {
+		return err
+	}
+
+	var slots []slot
+	for _, chain := range [][]*bucket{dstChain, srcChain} {
+		for _, b := range chain {
+			slots = append(slots, b.slots[:b.count]...)
+		}
+	}
+
+	if err := idx.writeChain(dstChain, slots); err != nil {
+		return err
+	}
+
+	for _, b := range srcChain {
+		if err := idx.pager.Free(int(b.id)); err != nil {
+			return err
+		}
+	}
+
+	return idx.dir.Truncate(len(idx.dir.Entries) - 1)
+}
+
+// readChain reads the bucket with given page id and all the overflow
+// buckets linked to it.
+func (idx *LinearHash) readChain(pageID int) ([]*bucket, error) {
+	b := &bucket{}
+	if err := idx.pager.Unmarshal(pageID, b); err != nil {
+		return nil, err
+	}
+
+	chain := []*bucket{b}
+	for {
+		next, err := b.next(idx)
 		if err != nil {
-			return nil, 0, err
+			return nil, err
+		} else if next == nil {
+			return chain, nil
 		}
+		chain = append(chain, next)
+		b = next
 	}
+}
+
+// writeChain packs the slots into the buckets of the chain and writes them.
+// Overflow buckets are allocated if the chain is not large enough. Overflow
+// buckets that are not required anymore are unlinked from the chain and
+// released to the free list.
+func (idx *LinearHash) writeChain(chain []*bucket, slots []slot) error {
+	for i := 0; ; i++ {
+		if i == len(chain) {
+			overflow, err := idx.allocBucket()
+			if err != nil {
+				return err
+			}
+			chain[i-1].overflow = overflow.id
+			chain = append(chain, overflow)
+		}
+
+		b := chain[i]
+		b.count = uint32(copy(b.slots, slots))
+		slots = slots[b.count:]
+
+		if len(slots) == 0 {
+			b.overflow = 0
+		}
 
-	return nil, 0, nil
+		if i > 0 {
+			if err := idx.pager.Marshal(int(chain[i-1].id), chain[i-1]); err != nil {
+				return err
+			}
+		}
+
+		if len(slots) > 0 {
+			continue
+		}
+
+		if err := idx.pager.Marshal(int(b.id), b); err != nil {
+			return err
+		}
+
+		for _, unused := range chain[i+1:] {
+			if err := idx.pager.Free(int(unused.id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 }
 
-func (idx *LinearHash) open() error {
+// allocBucket allocates a page for a new bucket. Pages freed earlier are
+// reused by the pager if available. The bucket is not written to the page
+// in this call.
+func (idx *LinearHash) allocBucket() (*bucket, error) {
+	pid, err := idx.pager.Alloc(1)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bucket{
+		bucketHeader: bucketHeader{id: uint32(pid)},
+		slots:        make([]slot, idx.slotCount),
+	}, nil
+}
+
+func (idx *LinearHash) open(opts Options) error {
+	idx.slotCount = (idx.pageSize - bucketHeaderSz) / slotSz
+	idx.dir = pagedir.New(idx.pager)
+
 	if idx.pager.Count() == 0 {
 		// empty file, so initialize it
-		return idx.init()
+		return idx.init(opts)
 	}
 
 	h := header{}
@@ -158,41 +521,98 @@ func (idx *LinearHash) open() error {
 		return err
 	}
 
-	idx.pageSize = int(h.pageSz)
-	return h.Validate()
+	if err := h.Validate(); err != nil {
+		return err
+	} else if int(h.pageSz) != idx.pageSize {
+		return fmt.Errorf("page size in header (%d) does not match pager (%d)", h.pageSz, idx.pageSize)
+	} else if err := opts.verify(h); err != nil {
+		return err
+	}
+	idx.header = h
+
+	return idx.dir.Load(int(h.dirPage), h.bucketCount())
 }
 
-func (idx *LinearHash) init() error {
+func (idx *LinearHash) init(opts Options) error {
 	if idx.isImmutable() {
 		return index.ErrImmutable
 	}
 
-	_, err := idx.pager.Alloc(1)
+	// page 0 for the header and page 1 for the first directory page.
+	_, err := idx.pager.Alloc(2)
+	if err != nil {
+		return err
+	}
+	idx.dir.Init(1)
+
+	seed, err := index.NewSeed()
 	if err != nil {
 		return err
 	}
 
-	return idx.pager.Marshal(0, header{
+	idx.header = header{
 		magic:   magic,
-		pageSz:  uint16(os.Getpagesize()),
+		pageSz:  uint32(idx.pageSize),
 		version: version,
-	})
+		dirPage: 1,
+		hashAlg: defaultHashAlg,
+		seed:    seed,
+	}
+
+	if err := opts.applyTo(&idx.header); err != nil {
+		return err
+	}
+
+	for i := 0; i < int(idx.header.initial); i++ {
+		b, err := idx.allocBucket()
+		if err != nil {
+			return err
+		}
+
+		if err := idx.pager.Marshal(int(b.id), b); err != nil {
+			return err
+		}
+
+		idx.dir.Append(int(b.id))
+		if err := idx.dir.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return idx.writeHeader()
+}
+
+func (idx *LinearHash) writeHeader() error {
+	return idx.pager.Marshal(0, idx.header)
 }
 
 func (idx *LinearHash) isImmutable() bool {
 	return idx.readOnly || idx.pager == nil
 }
 
+// loadFactor returns the ratio of entries to the number of slots in the
+// primary buckets.
+func (idx *LinearHash) loadFactor() float64 {
+	capacity := idx.header.bucketCount() * idx.slotCount
+	return float64(idx.header.count) / float64(capacity)
+}
+
+// hash returns the hash of the key using the algorithm and the seed stored
+// in the header. Hashes are stable across restarts and machines.
 func (idx *LinearHash) hash(key []byte) uint64 {
-	hasher := maphash.Hash{}
-	if _, err := hasher.Write(key); err != nil {
-		panic(err) // should never return error
-	}
-	return hasher.Sum64()
+	return index.XXH64(key, idx.header.seed)
 }
 
-func (idx *LinearHash) bucketIndex(hash uint64) uint32 {
-	return 0
+// bucketIndex returns the index of the primary bucket for the given hash.
+// Buckets before the split pointer have already been split in the current
+// level and are addressed using the next level hash function.
+func (idx *LinearHash) bucketIndex(hash uint64) int {
+	n := uint64(idx.header.initial) << idx.header.level
+	b := hash % n
+	if b < uint64(idx.header.split) {
+		b = hash % (2 * n)
+	}
+	return int(b)
 }
 
 type entry struct {
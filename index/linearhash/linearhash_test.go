@@ -1 +1,365 @@
 package linearhash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spy16/kiwi/index"
+)
+
+func TestLinearHash_Put_Get(t *testing.T) {
+	idx, err := Open(":memory:", nil)
+	if err != nil {
+		t.Fatalf("failed to init linear hash: %v", err)
+	}
+	defer idx.Close()
+
+	t.Run("Batch", func(t *testing.T) {
+		count := 10000
+
+		writeLot(t, idx, count)
+		if idx.Size() != int64(count) {
+			t.Errorf("expected size to be %d, not %d", count, idx.Size())
+		}
+
+		if idx.header.bucketCount() <= defaultInitialBuckets {
+			t.Errorf("expected buckets to be split, got %d buckets", idx.header.bucketCount())
+		}
+
+		if lf := idx.loadFactor(); lf > idx.header.maxLoad {
+			t.Errorf("expected load factor to be under %f, got %f", idx.header.maxLoad, lf)
+		}
+
+		readCheck(t, idx, count)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		size := idx.Size()
+
+		if err := idx.Put([]byte("hello"), 12345); err != nil {
+			t.Errorf("Put() unexpected error: %#v", err)
+		}
+
+		if err := idx.Put([]byte("hello"), 120012); err != nil {
+			t.Errorf("Put() unexpected error: %#v", err)
+		}
+
+		v, err := idx.Get([]byte("hello"))
+		if err != nil {
+			t.Errorf("Get('hello') unexpected error: %#v", err)
+		}
+
+		if v != 120012 {
+			t.Errorf("expected value of key 'hello' to be 120012, not %d", v)
+		}
+
+		if idx.Size() != size+1 {
+			t.Errorf("expected size to be %d, not %d", size+1, idx.Size())
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		if _, err := idx.Get([]byte("non-existent")); err != index.ErrKeyNotFound {
+			t.Errorf("Get() expected ErrKeyNotFound, got %#v", err)
+		}
+
+		if _, err := idx.Get(nil); err != index.ErrEmptyKey {
+			t.Errorf("Get() expected ErrEmptyKey, got %#v", err)
+		}
+	})
+}
+
+func TestLinearHash_Reopen(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "reopen.idx")
+
+	idx, err := Open(fileName, &Options{FileMode: 0644})
+	if err != nil {
+		t.Fatalf("failed to init linear hash: %v", err)
+	}
+	writeLot(t, idx, 5000)
+	seed := idx.header.seed
+	if err := idx.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	idx, err = Open(fileName, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("failed to reopen linear hash: %v", err)
+	}
+	defer idx.Close()
+
+	if idx.header.seed != seed {
+		t.Errorf("expected seed %#x to be persisted, got %#x", seed, idx.header.seed)
+	}
+	if idx.Size() != 5000 {
+		t.Errorf("expected size to be 5000, not %d", idx.Size())
+	}
+	readCheck(t, idx, 5000)
+}
+
+func TestLinearHash_LongKeys(t *testing.T) {
+	idx, err := Open(":memory:", nil)
+	if err != nil {
+		t.Fatalf("failed to init linear hash: %v", err)
+	}
+	defer idx.Close()
+
+	longKey := func(i int) []byte {
+		return []byte(fmt.Sprintf("a-rather-long-key-%08d", i))
+	}
+
+	for i := 0; i < 2000; i++ {
+		if err := idx.Put(longKey(i), uint64(i)); err != nil {
+			t.Fatalf("Put() unexpected error: %v", err)
+		}
+	}
+
+	for i := 0; i < 2000; i++ {
+		v, err := idx.Get(longKey(i))
+		if err != nil || v != uint64(i) {
+			t.Fatalf("Get('%s') expected %d, got %d (err=%v)", longKey(i), i, v, err)
+		}
+	}
+
+	if _, err := idx.Get([]byte("a-rather-long-key-xxxxxxxx")); err != index.ErrKeyNotFound {
+		t.Errorf("Get() expected ErrKeyNotFound, got %v", err)
+	}
+
+	if v, err := idx.Del(longKey(10)); err != nil || v != 10 {
+		t.Errorf("Del() expected 10, got %d (err=%v)", v, err)
+	}
+
+	if err := idx.Put(make([]byte, idx.pageSize+1), 1); err != index.ErrKeyTooLarge {
+		t.Errorf("Put() expected ErrKeyTooLarge, got %v", err)
+	}
+}
+
+func TestLinearHash_KeyHeapReuse(t *testing.T) {
+	idx, err := Open(":memory:", nil)
+	if err != nil {
+		t.Fatalf("failed to init linear hash: %v", err)
+	}
+	defer idx.Close()
+
+	longKey := func(i int) []byte {
+		return []byte(fmt.Sprintf("a-rather-long-key-%08d", i))
+	}
+
+	// heap pages of the deleted keys must be reused, so the file stops
+	// growing after the first round.
+	pages := 0
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 2000; i++ {
+			if err := idx.Put(longKey(i), uint64(i)); err != nil {
+				t.Fatalf("Put() unexpected error: %v", err)
+			}
+		}
+		for i := 0; i < 2000; i++ {
+			if _, err := idx.Del(longKey(i)); err != nil {
+				t.Fatalf("Del() unexpected error: %v", err)
+			}
+		}
+
+		if round == 0 {
+			pages = idx.pager.Count()
+		} else if idx.pager.Count() != pages {
+			t.Fatalf("round %d: expected %d pages, got %d", round, pages, idx.pager.Count())
+		}
+	}
+
+	if idx.header.keyOff != keyHeapHeaderSz {
+		t.Errorf("expected key heap page to be reset, offset is %d", idx.header.keyOff)
+	}
+}
+
+func TestLinearHash_slotMatches(t *testing.T) {
+	idx, err := Open(":memory:", nil)
+	if err != nil {
+		t.Fatalf("failed to init linear hash: %v", err)
+	}
+	defer idx.Close()
+
+	for _, key := range []string{"short", "a key that does not fit inline"} {
+		sl, err := idx.newSlot(entry{key: []byte(key), val: 1}, 0xABC)
+		if err != nil {
+			t.Fatalf("newSlot() unexpected error: %v", err)
+		}
+
+		match, err := idx.slotMatches(sl, []byte(key), 0xABC, index.Checksum([]byte(key)))
+		if err != nil || !match {
+			t.Errorf("slotMatches('%s') expected match, got %t (err=%v)", key, match, err)
+		}
+
+		// simulate a key with the same hash, size and checksum.
+		other := []byte(key)
+		other[0] = 'X'
+		match, err = idx.slotMatches(sl, other, 0xABC, index.Checksum([]byte(key)))
+		if err != nil || match {
+			t.Errorf("slotMatches('%s') expected colliding key to not match (err=%v)", other, err)
+		}
+	}
+}
+
+func TestLinearHash_Del(t *testing.T) {
+	idx, err := Open(":memory:", nil)
+	if err != nil {
+		t.Fatalf("failed to init linear hash: %v", err)
+	}
+	defer idx.Close()
+
+	count := 10000
+	writeLot(t, idx, count)
+	pages := idx.pager.Count()
+
+	for i := 0; i < count; i += 2 {
+		v, err := idx.Del(genKey(i))
+		if err != nil {
+			t.Fatalf("Del('%x') unexpected error: %v", genKey(i), err)
+		} else if v != uint64(i) {
+			t.Fatalf("Del('%x'): %d != %d", genKey(i), v, i)
+		}
+	}
+
+	if idx.Size() != int64(count/2) {
+		t.Errorf("expected size to be %d, not %d", count/2, idx.Size())
+	}
+
+	for i := 0; i < count; i++ {
+		v, err := idx.Get(genKey(i))
+		if i%2 == 0 && err != index.ErrKeyNotFound {
+			t.Fatalf("Get('%x') expected ErrKeyNotFound, got %v", genKey(i), err)
+		} else if i%2 == 1 && (err != nil || v != uint64(i)) {
+			t.Fatalf("Get('%x') expected %d, got %d (err=%v)", genKey(i), i, v, err)
+		}
+	}
+
+	if _, err := idx.Del(genKey(0)); err != index.ErrKeyNotFound {
+		t.Errorf("Del() expected ErrKeyNotFound for deleted key, got %v", err)
+	}
+
+	for i := 1; i < count; i += 2 {
+		if _, err := idx.Del(genKey(i)); err != nil {
+			t.Fatalf("Del('%x') unexpected error: %v", genKey(i), err)
+		}
+	}
+
+	if idx.Size() != 0 {
+		t.Errorf("expected size to be 0, not %d", idx.Size())
+	}
+
+	if idx.header.bucketCount() != defaultInitialBuckets {
+		t.Errorf("expected buckets to be merged back to %d, got %d",
+			defaultInitialBuckets, idx.header.bucketCount())
+	}
+
+	if idx.pager.Stats().Frees == 0 {
+		t.Errorf("expected merged pages to be freed")
+	}
+
+	// re-inserting should reuse the freed pages.
+	writeLot(t, idx, count)
+	readCheck(t, idx, count)
+	if idx.pager.Count() != pages {
+		t.Errorf("expected freed pages to be reused, page count %d != %d", idx.pager.Count(), pages)
+	}
+}
+
+func readCheck(t *testing.T, idx *LinearHash, count int) {
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		key := genKey(i)
+
+		v, err := idx.Get(key)
+		if err != nil {
+			t.Fatalf("Get('%x') unexpected error: %#v", key, err)
+		}
+
+		if v != uint64(i) {
+			t.Fatalf("Get('%x'): %d != %d", key, v, i)
+		}
+	}
+	t.Logf("read %d keys in %s", count, time.Since(start))
+}
+
+func writeLot(t *testing.T, idx *LinearHash, count int) {
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		if err := idx.Put(genKey(i), uint64(i)); err != nil {
+			t.Fatalf("Put() unexpected error: %v", err)
+		}
+	}
+	t.Logf("inserted %d keys in %s", count, time.Since(start))
+}
+
+func genKey(i int) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(i))
+	return b[:]
+}
+
+func TestLinearHash_Options(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "opts.idx")
+
+	idx, err := Open(fileName, &Options{
+		FileMode:       0644,
+		PageSize:       1024,
+		InitialBuckets: 64,
+		MaxLoadFactor:  0.9,
+		MinLoadFactor:  -1,
+	})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+
+	// presized table should not split until the load factor is reached.
+	count := int(0.9 * float64(64*idx.slotCount))
+	writeLot(t, idx, count)
+	if idx.header.bucketCount() != 64 {
+		t.Errorf("expected no splits for %d entries, got %d buckets", count, idx.header.bucketCount())
+	}
+	if err := idx.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	mismatches := []Options{
+		{PageSize: 4096},
+		{InitialBuckets: 4},
+		{MaxLoadFactor: 0.75},
+		{MinLoadFactor: 0.25},
+	}
+	for _, opts := range mismatches {
+		if _, err := Open(fileName, &opts); err == nil {
+			t.Errorf("Open() expected error for mismatched options %+v", opts)
+		}
+	}
+
+	// zero valued options use the persisted values.
+	idx, err = Open(fileName, &Options{ReadOnly: true, MinLoadFactor: -1})
+	if err != nil {
+		t.Fatalf("Open() unexpected error on reopen: %v", err)
+	}
+	defer idx.Close()
+
+	if idx.pageSize != 1024 || idx.header.initial != 64 || idx.header.maxLoad != 0.9 || idx.header.minLoad != 0 {
+		t.Errorf("unexpected sizing after reopen: %s", idx)
+	}
+	readCheck(t, idx, count)
+}
+
+func TestLinearHash_InvalidOptions(t *testing.T) {
+	invalid := []Options{
+		{PageSize: 1000},
+		{InitialBuckets: -1},
+		{MaxLoadFactor: -0.5},
+		{MaxLoadFactor: 0.5, MinLoadFactor: 0.3},
+	}
+
+	for _, opts := range invalid {
+		if _, err := Open(":memory:", &opts); err == nil {
+			t.Errorf("Open() expected error for invalid options %+v", opts)
+		}
+	}
+}
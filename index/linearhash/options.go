@@ -1,14 +1,137 @@
 package linearhash
 
-import "os"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spy16/kiwi/pager"
+)
+
+// minPageSize is the smallest page size allowed. Page size must also be a
+// multiple of this.
+const minPageSize = 512
+
+// defaults used when initializing a new index file.
+const (
+	defaultInitialBuckets = 4
+	defaultMaxLoadFactor  = 0.75
+	defaultMinLoadFactor  = 0.25
+)
 
 var defaultOptions = Options{
 	ReadOnly: false,
 	FileMode: os.ModePerm,
 }
 
-// Options can be provided to Open() to configure initialization.
+// Options can be provided to Open() to configure initialization. Sizing
+// options are persisted in the index file when it is initialized. If set
+// while opening an existing index file, they must match the persisted
+// values. Zero values use the persisted values for existing files and the
+// defaults for new files.
 type Options struct {
 	ReadOnly bool
 	FileMode os.FileMode
+
+	// PageSize to be used for file I/O. Must be a multiple of 512.
+	// Defaults to os.Getpagesize().
+	PageSize int
+
+	// InitialBuckets is the number of buckets to create when the index is
+	// initialized. Presizing the table for a known cardinality avoids the
+	// splits during warm-up. Defaults to 4.
+	InitialBuckets int
+
+	// MaxLoadFactor is the ratio of entries to slots in primary buckets
+	// at which a bucket is split. Defaults to 0.75.
+	MaxLoadFactor float64
+
+	// MinLoadFactor is the ratio of entries to slots in primary buckets
+	// below which the last bucket is merged. Must be less than half of
+	// MaxLoadFactor. Use a negative value to disable merging. Defaults to
+	// 0.25.
+	MinLoadFactor float64
+
+	// LockTimeout is the maximum time to wait for the lock on the index
+	// file held by another process. Open() fails with pager.ErrLocked if
+	// the lock could not be acquired. If 0, fails immediately.
+	LockTimeout time.Duration
+
+	// IOMode selects how the index file is accessed. Defaults to
+	// pager.IOMmap.
+	IOMode pager.IOMode
+}
+
+// applyTo sets the sizing options in the header of a new index file.
+func (opts Options) applyTo(h *header) error {
+	h.initial = defaultInitialBuckets
+	if opts.InitialBuckets != 0 {
+		h.initial = uint32(opts.InitialBuckets)
+	}
+
+	h.maxLoad = defaultMaxLoadFactor
+	if opts.MaxLoadFactor != 0 {
+		h.maxLoad = opts.MaxLoadFactor
+	}
+
+	h.minLoad = defaultMinLoadFactor
+	if opts.MinLoadFactor < 0 {
+		h.minLoad = 0
+	} else if opts.MinLoadFactor != 0 {
+		h.minLoad = opts.MinLoadFactor
+	}
+
+	if opts.InitialBuckets < 0 {
+		return errors.New("initial bucket count must be positive")
+	}
+	return validateLoadFactors(h.minLoad, h.maxLoad)
+}
+
+// verify ensures that the sizing options, if set, match the header of an
+// existing index file.
+func (opts Options) verify(h header) error {
+	if opts.PageSize != 0 && opts.PageSize != int(h.pageSz) {
+		return fmt.Errorf("page size %d does not match index file (%d)", opts.PageSize, h.pageSz)
+	}
+
+	if opts.InitialBuckets != 0 && opts.InitialBuckets != int(h.initial) {
+		return fmt.Errorf("initial buckets %d does not match index file (%d)", opts.InitialBuckets, h.initial)
+	}
+
+	if opts.MaxLoadFactor != 0 && opts.MaxLoadFactor != h.maxLoad {
+		return fmt.Errorf("max load factor %f does not match index file (%f)", opts.MaxLoadFactor, h.maxLoad)
+	}
+
+	minLoad := opts.MinLoadFactor
+	if minLoad < 0 {
+		minLoad = 0
+	} else if minLoad == 0 {
+		minLoad = h.minLoad
+	}
+
+	if minLoad != h.minLoad {
+		return fmt.Errorf("min load factor %f does not match index file (%f)", opts.MinLoadFactor, h.minLoad)
+	}
+
+	return nil
+}
+
+func validatePageSize(pageSz int) error {
+	if pageSz < minPageSize || pageSz%minPageSize != 0 {
+		return fmt.Errorf("invalid page size %d, must be a multiple of %d", pageSz, minPageSize)
+	}
+	return nil
+}
+
+// validateLoadFactors ensures the split and merge thresholds are sane. Min
+// load factor must be less than half of the max load factor, otherwise a
+// split could immediately be followed by a merge.
+func validateLoadFactors(minLoad, maxLoad float64) error {
+	if !(maxLoad > 0) {
+		return errors.New("max load factor must be positive")
+	} else if !(minLoad >= 0 && minLoad < maxLoad/2) {
+		return errors.New("min load factor must be less than half of max load factor")
+	}
+	return nil
 }
@@ -0,0 +1,24 @@
+package fileutil
+
+import (
+	"os"
+	"syscall"
+)
+
+// Allocate grows the file from 'size' to 'target' bytes. On Linux, the space
+// is reserved using fallocate(2) so that the writes to the new blocks do not
+// fail with ENOSPC. Interrupted calls are retried and truncate is used only
+// if fallocate is not supported by the file system.
+func Allocate(f *os.File, size, target int64) error {
+	for {
+		err := syscall.Fallocate(int(f.Fd()), 0, size, target-size)
+		switch err {
+		case syscall.EINTR:
+			continue
+
+		case syscall.EOPNOTSUPP, syscall.ENOSYS:
+			return f.Truncate(target)
+		}
+		return err
+	}
+}
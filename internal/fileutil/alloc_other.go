@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package fileutil
+
+import "os"
+
+// Allocate grows the file from 'size' to 'target' bytes.
+func Allocate(f *os.File, size, target int64) error {
+	return f.Truncate(target)
+}
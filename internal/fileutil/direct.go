@@ -0,0 +1,23 @@
+package fileutil
+
+import "unsafe"
+
+// DirectAlignment is the alignment of buffers, offsets and sizes required
+// for direct I/O.
+const DirectAlignment = 4096
+
+// AlignedBuffer returns a zeroed buffer of size 'n' with the start address
+// aligned to DirectAlignment.
+func AlignedBuffer(n int) []byte {
+	buf := make([]byte, n+DirectAlignment)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % DirectAlignment); rem != 0 {
+		shift = DirectAlignment - rem
+	}
+	return buf[shift : shift+n : shift+n]
+}
+
+// AlignUp rounds 'n' up to a multiple of DirectAlignment.
+func AlignUp(n int) int {
+	return (n + DirectAlignment - 1) / DirectAlignment * DirectAlignment
+}
@@ -0,0 +1,6 @@
+package fileutil
+
+import "syscall"
+
+// DirectFlag is the flag for opening files for direct I/O.
+const DirectFlag = syscall.O_DIRECT
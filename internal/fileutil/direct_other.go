@@ -0,0 +1,7 @@
+//go:build !linux
+// +build !linux
+
+package fileutil
+
+// DirectFlag is 0 since direct I/O is supported only on Linux.
+const DirectFlag = 0
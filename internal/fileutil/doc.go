@@ -0,0 +1,3 @@
+// Package fileutil provides the file handling helpers shared by the pager
+// and the block files in package io.
+package fileutil
@@ -0,0 +1,51 @@
+package fileutil
+
+// DefaultGrowthChunk is the maximum number of bytes a file is grown by at a
+// time unless configured otherwise.
+const DefaultGrowthChunk = 64 << 20
+
+// bounds for the size of the region mapped beyond the end of the file.
+const (
+	minMapSize = 1 << 20
+	maxMapStep = 1 << 30
+)
+
+// GrowSize returns the size a file of given size must be grown to, so that
+// it is at-least 'required' bytes. Size is doubled until the growth reaches
+// 'chunk' bytes and is rounded up to a multiple of 'unit'. Empty files start
+// at one unit.
+func GrowSize(size, required, chunk, unit int64) int64 {
+	target := size
+	if target == 0 {
+		target = unit
+	}
+
+	for target < required {
+		step := target
+		if step > chunk {
+			step = chunk
+		}
+		target += step
+	}
+
+	if rem := target % unit; rem != 0 {
+		target += unit - rem
+	}
+	return target
+}
+
+// MapRegionSize returns the size of the region to be mapped for a file of
+// given size. Region is the next power of 2 (at-least 1MB) until 1GB after
+// which it grows in steps of 1GB, so that a growing file is remapped only
+// once in a while.
+func MapRegionSize(fileSize int64) int64 {
+	if fileSize > maxMapStep {
+		return (fileSize + maxMapStep - 1) / maxMapStep * maxMapStep
+	}
+
+	size := int64(minMapSize)
+	for size < fileSize {
+		size *= 2
+	}
+	return size
+}
@@ -0,0 +1,44 @@
+package fileutil
+
+import "testing"
+
+func TestGrowSize(t *testing.T) {
+	const mb = 1 << 20
+
+	table := []struct {
+		size, required, chunk, unit int64
+		want                        int64
+	}{
+		{size: 0, required: 1, chunk: 64 * mb, unit: 4096, want: 4096},
+		{size: 4096, required: 4097, chunk: 64 * mb, unit: 4096, want: 8192},
+		{size: 4096, required: 20000, chunk: 64 * mb, unit: 4096, want: 32768},
+		{size: 64 * mb, required: 64*mb + 1, chunk: 16 * mb, unit: 4096, want: 80 * mb},
+		{size: 4096, required: 4097, chunk: 4096, unit: 4096, want: 8192},
+		{size: 512, required: 600, chunk: 100, unit: 512, want: 1024},
+	}
+
+	for _, tt := range table {
+		if got := GrowSize(tt.size, tt.required, tt.chunk, tt.unit); got != tt.want {
+			t.Errorf("GrowSize(%d, %d, %d, %d) expected %d, got %d",
+				tt.size, tt.required, tt.chunk, tt.unit, tt.want, got)
+		}
+	}
+}
+
+func TestMapRegionSize(t *testing.T) {
+	table := map[int64]int64{
+		0:              minMapSize,
+		4096:           minMapSize,
+		minMapSize:     minMapSize,
+		3 << 20:        4 << 20,
+		maxMapStep:     maxMapStep,
+		5 << 29:        3 << 30,
+		maxMapStep * 2: maxMapStep * 2,
+	}
+
+	for size, want := range table {
+		if got := MapRegionSize(size); got != want {
+			t.Errorf("MapRegionSize(%d) expected %d, got %d", size, want, got)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package fileutil
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// lockRetryInterval is the interval between attempts to acquire a file lock
+// held by another process.
+const lockRetryInterval = 10 * time.Millisecond
+
+// ErrLocked is returned by Lock() when the file is locked by another process
+// (or another open file in this process) and the lock could not be acquired
+// within the timeout.
+var ErrLocked = errors.New("file is locked by another process")
+
+// Lock acquires an advisory lock on the file. Exclusive lock is taken for
+// writers and shared lock for readers, so that multiple readers can open the
+// file at the same time. If the lock is held, acquiring is retried until the
+// timeout expires. The lock is released when the file is closed.
+func Lock(f *os.File, exclusive bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		acquired, err := tryLock(f, exclusive)
+		if err != nil {
+			return err
+		} else if acquired {
+			return nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return ErrLocked
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
@@ -4,11 +4,19 @@ import (
 	"fmt"
 	"io"
 	"os"
+
+	"github.com/spy16/kiwi/internal/fileutil"
 )
 
+// ErrLocked is returned by Open() when the file is locked by another process
+// and the lock could not be acquired within the timeout. Same as the error
+// returned by the pager, so that both can be checked at once.
+var ErrLocked = fileutil.ErrLocked
+
 // BlockFile provides facilities for low-level paged I/O on memory mapped,
-// random access files. BlockFile is NOT safe for concurrent use. BlockFile
-// gives direct access to memory mapped region and incorrect usage can cause
+// random access files. BlockFile implementations are safe for concurrent
+// use, but the data in the slices is not synchronized. BlockFile gives
+// direct access to memory mapped region and incorrect usage can cause
 // segfaults or unexpected behaviors.
 type BlockFile interface {
 	io.Closer
@@ -18,28 +26,53 @@ type BlockFile interface {
 	Alloc(n int) (id int, slice []byte, err error)
 
 	// Slice returns a slice of the memory mapped region starting at the block
-	// with the given id. Alloc() calls may invalidate the returned slice. It
-	// is caller's responsibility to co-ordinate Alloc() and Slice() calls.
+	// with the given id. Whether Alloc() calls invalidate the returned slice
+	// depends on the implementation. Files that are not memory mapped
+	// return a copy of the block, so changes must be written using Write().
 	Slice(id int) ([]byte, error)
 
+	// Write writes the data to the block with the given id. Data smaller
+	// than a block is zero padded.
+	Write(id int, d []byte) error
+
+	// Sync flushes the memory mapped region and the file contents to the
+	// stable storage.
+	Sync() error
+
+	// Trim discards the blocks from 'count' onwards. Block count of a file
+	// that was not closed cleanly may include the blocks pre-allocated by
+	// Alloc(), so users of BlockFile must persist the number of blocks in
+	// use and trim the rest when opening. Slices of the discarded blocks
+	// must not be used.
+	Trim(count int) error
+
 	// Info returns information about the block file state/configuration.
 	Info() (name string, count, blockSz int, readOnly bool)
 }
 
 // Open opens the named file and returns a BlockFile instance for it. If the
 // file doesn't exist, it will be created. If the fileName is ':memory:', an
-// in-memory block-file will be returned.
-func Open(fileName string, blockSz int, readOnly bool, mode os.FileMode) (BlockFile, error) {
+// in-memory block-file will be returned. File is locked exclusively, or
+// shared if opened in read-only mode. If the lock is held by another process
+// Open waits up to opts.LockTimeout and fails with ErrLocked.
+func Open(fileName string, opts *Options) (BlockFile, error) {
+	if opts == nil {
+		opts = &defaultOptions
+	}
+
+	blockSz := opts.BlockSize
+	if blockSz == 0 {
+		blockSz = os.Getpagesize()
+	} else if blockSz < 4096 || blockSz%4096 != 0 {
+		return nil, fmt.Errorf("invalid blockSize, must be non-zero multiple of 4096")
+	}
+
 	if fileName == ":memory:" {
 		return &InMem{
 			blockSz:  blockSz,
-			readOnly: readOnly,
+			readOnly: opts.ReadOnly,
 		}, nil
 	}
 
-	if (blockSz < 4096) || blockSz%4096 != 0 {
-		return nil, fmt.Errorf("invalid blockSize, must be non-zero multiple of 4096")
-	}
-
-	return openOnDisk(fileName, blockSz, readOnly, mode)
+	return openOnDisk(fileName, blockSz, *opts)
 }
@@ -1,12 +1,18 @@
 package io
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
 
 var _ BlockFile = (*InMem)(nil)
 
 // InMem implements an ephemeral BlockFile using in-memory byte slice.
-// This implementation of BlockFile is meant for testing only.
+// This implementation of BlockFile is meant for testing only. InMem is safe
+// for concurrent use, but Alloc() invalidates the slices returned earlier.
 type InMem struct {
+	mu       sync.RWMutex
 	blockSz  int
 	readOnly bool
 	closed   bool
@@ -18,6 +24,12 @@ type InMem struct {
 // segfaults or unexpected behavior. Any Alloc() calls will invalidate the
 // returned slice.
 func (mem *InMem) Slice(id int) ([]byte, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	return mem.slice(id)
+}
+
+func (mem *InMem) slice(id int) ([]byte, error) {
 	offset := id * mem.blockSz
 	if id < 0 || offset >= len(mem.data) {
 		return nil, errors.New("non-existent block")
@@ -27,21 +39,72 @@ func (mem *InMem) Slice(id int) ([]byte, error) {
 
 // Alloc allocates n new sequential blocks and returns the id of the first.
 func (mem *InMem) Alloc(n int) (int, []byte, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
 	size := mem.blockSz * n
 	id := len(mem.data) / mem.blockSz
 	mem.data = append(mem.data, make([]byte, size)...)
 
-	sl, err := mem.Slice(id)
+	sl, err := mem.slice(id)
 	return id, sl, err
 }
 
+// Write writes the data to the block with the given id. Data smaller than
+// a block is zero padded.
+func (mem *InMem) Write(id int, d []byte) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	offset := id * mem.blockSz
+	if id < 0 || offset >= len(mem.data) {
+		return errors.New("non-existent block")
+	} else if len(d) > mem.blockSz {
+		return errors.New("data is larger than a block")
+	}
+
+	block := mem.data[offset : offset+mem.blockSz]
+	n := copy(block, d)
+	for i := n; i < len(block); i++ {
+		block[i] = 0
+	}
+	return nil
+}
+
+// Trim discards the blocks from 'count' onwards.
+func (mem *InMem) Trim(count int) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	if count < 0 || count*mem.blockSz > len(mem.data) {
+		return fmt.Errorf("invalid block count %d (max=%d)", count, len(mem.data)/mem.blockSz)
+	}
+	mem.data = mem.data[:count*mem.blockSz]
+	return nil
+}
+
 // Info returns information about the block file state/configuration.
 func (mem *InMem) Info() (name string, count, blockSz int, readOnly bool) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
 	return ":memory:", len(mem.data) / mem.blockSz, mem.blockSz, mem.readOnly
 }
 
+// Sync is a no-op for in-memory block file.
+func (mem *InMem) Sync() error {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	if mem.closed {
+		return errors.New("closed file")
+	}
+	return nil
+}
+
 // Close flushes any pending writes and closes the file.
 func (mem *InMem) Close() error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
 	if mem.closed {
 		return nil
 	}
@@ -2,42 +2,53 @@ package io
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"sync"
 
 	"github.com/edsrzf/mmap-go"
+	"github.com/spy16/kiwi/internal/fileutil"
+	"github.com/spy16/kiwi/pager"
 )
 
 var _ BlockFile = (*OnDisk)(nil)
 
-// disableMmap disables memory mapped I/O in OnDisk block file. meant for
-// debugging only.
-const disableMmap = false
-
-func openOnDisk(fileName string, blockSz int, readOnly bool, mode os.FileMode) (*OnDisk, error) {
+func openOnDisk(fileName string, blockSz int, opts Options) (*OnDisk, error) {
 	var bf OnDisk
 
-	if blockSz == 0 {
-		blockSz = os.Getpagesize()
-	} else if blockSz < 4096 || blockSz%4096 != 0 {
-		return nil, errors.New("block size must be multple of 4096")
-	}
-
 	mmapFlag := mmap.RDWR
 	flag := os.O_CREATE | os.O_RDWR
-	if readOnly {
+	if opts.ReadOnly {
 		mmapFlag = mmap.RDONLY
 		flag = os.O_CREATE | os.O_RDONLY
 	}
 
-	f, err := os.OpenFile(fileName, flag, mode)
+	switch opts.IOMode {
+	case pager.IOMmap, pager.IOPread:
+	case pager.IODirect:
+		if fileutil.DirectFlag == 0 {
+			return nil, errors.New("direct I/O is not supported on this platform")
+		}
+		flag |= fileutil.DirectFlag
+	default:
+		return nil, fmt.Errorf("invalid I/O mode %s", opts.IOMode)
+	}
+
+	f, err := os.OpenFile(fileName, flag, opts.FileMode)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := fileutil.Lock(f, !opts.ReadOnly, opts.LockTimeout); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
 	bf = OnDisk{
 		file:      f,
-		readOnly:  readOnly,
+		readOnly:  opts.ReadOnly,
+		ioMode:    opts.IOMode,
 		blockSize: blockSz,
 		mmapFlag:  mmapFlag,
 	}
@@ -48,6 +59,7 @@ func openOnDisk(fileName string, blockSz int, readOnly bool, mode os.FileMode) (
 		return nil, err
 	}
 	bf.size = fi.Size()
+	bf.count = int(bf.size) / blockSz
 
 	if err := bf.mmap(); err != nil {
 		_ = bf.Close()
@@ -57,82 +69,250 @@ func openOnDisk(fileName string, blockSz int, readOnly bool, mode os.FileMode) (
 	return &bf, nil
 }
 
-// OnDisk implements a memory mapped BlockFile using an on-disk file.
+// OnDisk implements a memory mapped BlockFile using an on-disk file. File is
+// grown ahead of the blocks handed out by Alloc() and a region larger than
+// the file is mapped to avoid resizing and remapping on every Alloc(). The
+// pre-allocated space is trimmed when the file is closed, or by Trim() when
+// opening a file that was not closed cleanly. OnDisk is safe for
+// concurrent use. Regions replaced by a remap are unmapped only on Close(),
+// so slices returned earlier remain valid until then.
+//
+// In pager.IOPread and pager.IODirect modes, the file is not mapped and
+// blocks are read and written individually using pread(2) and pwrite(2),
+// with O_DIRECT and aligned buffers in direct mode.
 type OnDisk struct {
+	mu        sync.RWMutex
 	file      *os.File
 	data      mmap.MMap
-	size      int64
+	retired   []mmap.MMap // regions replaced by remaps
+	size      int64       // size of the file including the pre-allocated space
+	count     int         // number of blocks handed out
+	mapSize   int64
 	readOnly  bool
 	mmapFlag  int
+	ioMode    pager.IOMode
 	blockSize int
 }
 
 // Slice returns a slice of the memory mapped region starting at the block
 // with the given id. Incorrect handling of the returned slice can cause
-// segfaults or unexpected behavior. Any Alloc() calls may invalidate the
-// returned slice.
+// segfaults or unexpected behavior. Returned slice remains valid until the
+// file is closed, but does not cover blocks allocated after the call. If
+// the file is not memory mapped, a copy of the block read from the file is
+// returned.
 func (bf *OnDisk) Slice(id int) ([]byte, error) {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	return bf.slice(id)
+}
+
+func (bf *OnDisk) slice(id int) ([]byte, error) {
 	off := int64(bf.offset(id))
 
-	if id < 0 || off >= bf.size {
+	if id < 0 || id >= bf.count {
 		return nil, io.EOF
-	} else if bf.file == nil || bf.data == nil {
+	} else if bf.file == nil {
 		return nil, os.ErrClosed
 	}
 
-	return bf.data[off:], nil
+	if bf.ioMode != pager.IOMmap {
+		d := bf.newBuffer(bf.blockSize)
+		if _, err := bf.file.ReadAt(d, off); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	if bf.data == nil {
+		return nil, os.ErrClosed
+	}
+	return bf.data[off:bf.offset(bf.count)], nil
+}
+
+// Write writes the data to the block with the given id. Data smaller than
+// a block is zero padded.
+func (bf *OnDisk) Write(id int, d []byte) error {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+
+	if bf.file == nil {
+		return os.ErrClosed
+	} else if bf.readOnly {
+		return errors.New("read-only file")
+	} else if id < 0 || id >= bf.count {
+		return fmt.Errorf("invalid block id %d (max=%d)", id, bf.count-1)
+	} else if len(d) > bf.blockSize {
+		return errors.New("data is larger than a block")
+	}
+
+	off := bf.offset(id)
+	if bf.ioMode == pager.IOMmap {
+		n := copy(bf.data[off:off+bf.blockSize], d)
+		for i := off + n; i < off+bf.blockSize; i++ {
+			bf.data[i] = 0
+		}
+		return nil
+	}
+
+	block := bf.newBuffer(bf.blockSize)
+	copy(block, d)
+	_, err := bf.file.WriteAt(block, int64(off))
+	return err
 }
 
 // Alloc will allocate 'n' sequential blocks and return the first id and
 // slice to the first block.
 func (bf *OnDisk) Alloc(n int) (int, []byte, error) {
-	id := int(bf.size) / bf.blockSize
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
 
-	targetSz := bf.size + int64(n*bf.blockSize)
-	_ = bf.unmap()
-	if err := bf.file.Truncate(targetSz); err != nil {
-		return 0, nil, err
+	if bf.file == nil {
+		return 0, nil, os.ErrClosed
+	} else if bf.readOnly {
+		return 0, nil, errors.New("read-only file")
 	}
 
-	bf.size = targetSz
-	if err := bf.mmap(); err != nil {
-		return 0, nil, err
+	id := bf.count
+	if required := int64(bf.offset(id + n)); required > bf.size {
+		if err := bf.grow(required); err != nil {
+			return 0, nil, err
+		}
+	}
+	bf.count += n
+
+	if bf.ioMode != pager.IOMmap {
+		// blocks beyond the file size are zero.
+		return id, bf.newBuffer(n * bf.blockSize), nil
 	}
 
-	sl, err := bf.Slice(id)
+	sl, err := bf.slice(id)
 	return id, sl, err
 }
 
+// Trim discards the blocks from 'count' onwards and truncates the file to
+// the remaining blocks unless opened in read-only mode.
+func (bf *OnDisk) Trim(count int) error {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+
+	if bf.file == nil {
+		return os.ErrClosed
+	} else if count < 0 || count > bf.count {
+		return fmt.Errorf("invalid block count %d (max=%d)", count, bf.count)
+	}
+
+	if !bf.readOnly {
+		size := int64(bf.offset(count))
+		if err := bf.file.Truncate(size); err != nil {
+			return err
+		}
+		bf.size = size
+	}
+	bf.count = count
+	return nil
+}
+
 // Info returns information about the block file state/configuration.
 func (bf *OnDisk) Info() (name string, count, blockSz int, readOnly bool) {
-	return bf.file.Name(), int(bf.size) / bf.blockSize, bf.blockSize, bf.readOnly
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	return bf.file.Name(), bf.count, bf.blockSize, bf.readOnly
+}
+
+// Sync flushes the memory mapped region (msync) and the file (fsync) to
+// stable storage.
+func (bf *OnDisk) Sync() error {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+
+	if bf.file == nil {
+		return os.ErrClosed
+	} else if bf.readOnly {
+		return nil
+	}
+
+	if bf.data != nil {
+		if err := bf.data.Flush(); err != nil {
+			return err
+		}
+	}
+	return bf.file.Sync()
 }
 
 // Close flushes any pending writes and closes the underlying file.
 func (bf *OnDisk) Close() error {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+
 	if bf.file == nil {
 		return nil
 	}
 	_ = bf.unmap()
-	err := bf.file.Close()
+	for _, d := range bf.retired {
+		_ = d.Unmap()
+	}
+	bf.retired = nil
+
+	// trim the pre-allocated space so that the block count can be derived
+	// from the file size when opened again.
+	var err error
+	if !bf.readOnly && bf.size > int64(bf.offset(bf.count)) {
+		err = bf.file.Truncate(int64(bf.offset(bf.count)))
+	}
+
+	if closeErr := bf.file.Close(); err == nil {
+		err = closeErr
+	}
 	bf.file = nil
 	return err
 }
 
+// grow extends the file to be at-least 'required' bytes. File size is
+// doubled until the growth reaches fileutil.DefaultGrowthChunk. Caller must
+// hold mu exclusively.
+func (bf *OnDisk) grow(required int64) error {
+	target := fileutil.GrowSize(bf.size, required, fileutil.DefaultGrowthChunk, int64(bf.blockSize))
+	if err := fileutil.Allocate(bf.file, bf.size, target); err != nil {
+		return err
+	}
+	bf.size = target
+
+	if bf.data == nil || target > bf.mapSize {
+		return bf.mmap()
+	}
+	return nil
+}
+
+// newBuffer returns a buffer for reading or writing 'n' bytes, aligned for
+// direct I/O if required.
+func (bf *OnDisk) newBuffer(n int) []byte {
+	if bf.ioMode == pager.IODirect {
+		return fileutil.AlignedBuffer(n)
+	}
+	return make([]byte, n)
+}
+
 func (bf *OnDisk) mmap() error {
-	if disableMmap || bf.file == nil || bf.size <= 0 {
+	if bf.ioMode != pager.IOMmap || bf.file == nil || bf.size <= 0 {
 		return nil
 	}
 
-	if err := bf.unmap(); err != nil {
-		return err
+	mapSize := bf.size
+	if !bf.readOnly {
+		mapSize = fileutil.MapRegionSize(bf.size)
 	}
 
-	d, err := mmap.Map(bf.file, bf.mmapFlag, 0)
+	d, err := mmap.MapRegion(bf.file, int(mapSize), bf.mmapFlag, 0, 0)
 	if err != nil {
 		return err
 	}
+
+	// slices of the previous region may still be in use.
+	if bf.data != nil {
+		bf.retired = append(bf.retired, bf.data)
+	}
 	bf.data = d
+	bf.mapSize = mapSize
 	return nil
 }
 
@@ -140,7 +320,10 @@ func (bf *OnDisk) unmap() error {
 	if bf.file == nil || bf.data == nil {
 		return nil
 	}
-	return bf.data.Unmap()
+	err := bf.data.Unmap()
+	bf.data = nil
+	bf.mapSize = 0
+	return err
 }
 
 func (bf *OnDisk) offset(id int) int { return id * bf.blockSize }
@@ -0,0 +1,33 @@
+package io
+
+import (
+	"os"
+	"time"
+
+	"github.com/spy16/kiwi/pager"
+)
+
+var defaultOptions = Options{
+	ReadOnly: false,
+	FileMode: 0644,
+}
+
+// Options can be provided to Open() to configure the block file.
+type Options struct {
+	ReadOnly bool
+	FileMode os.FileMode
+
+	// BlockSize must be a non-zero multiple of 4096. If 0, os.Getpagesize()
+	// is used.
+	BlockSize int
+
+	// LockTimeout is the maximum time to wait for the file lock held by
+	// another process. If 0, Open() fails with ErrLocked immediately.
+	LockTimeout time.Duration
+
+	// IOMode selects how the file is accessed. With pager.IOPread and
+	// pager.IODirect, the file is not memory mapped and every block is read
+	// and written individually using pread/pwrite, with O_DIRECT in case
+	// of pager.IODirect. Defaults to pager.IOMmap.
+	IOMode pager.IOMode
+}
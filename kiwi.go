@@ -1,13 +1,33 @@
 package kiwi
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"sync"
+	"time"
 
-	"github.com/spy16/kiwi/io"
+	"github.com/spy16/kiwi/index"
+	"github.com/spy16/kiwi/index/bptree"
+	"github.com/spy16/kiwi/index/exthash"
+	"github.com/spy16/kiwi/index/linearhash"
+	"github.com/spy16/kiwi/pager"
 )
 
+// defaultMaxKeySize is the maximum key size used for B+ tree index.
+const defaultMaxKeySize = 100
+
+// ErrLocked is returned by Open() when the database or index file is locked
+// by another process.
+var ErrLocked = pager.ErrLocked
+
+// indexer is an index that holds resources to be released on close.
+type indexer interface {
+	index.Index
+	Sync() error
+	Close() error
+}
+
 // Open opens the named file as Kiwi database and returns a DB instance for
 // accessing it. If the file doesn't exist, it will be created and initialized
 // if not in read-only mode.
@@ -20,50 +40,202 @@ func Open(filePath string, opts *Options) (*DB, error) {
 		opts.Log = func(msg string, args ...interface{}) {}
 	}
 
-	bf, err := io.Open(filePath, os.Getpagesize(), opts.ReadOnly, opts.FileMode)
+	if opts.SyncMode == pager.SyncPeriodic && opts.SyncInterval <= 0 {
+		return nil, errors.New("sync interval must be positive for periodic sync")
+	}
+
+	p, err := pager.Open(filePath, &pager.Options{
+		ReadOnly:    opts.ReadOnly,
+		FileMode:    opts.FileMode,
+		PageSize:    os.Getpagesize(),
+		LockTimeout: opts.LockTimeout,
+		Owner:       pager.OwnerKiwi,
+		IOMode:      opts.IOMode,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := initHeader(p, opts.IndexType); err != nil {
+		_ = p.Close()
+		return nil, err
+	}
+
+	idx, err := openIndex(filePath, *opts)
 	if err != nil {
+		_ = p.Close()
 		return nil, err
 	}
 
-	return &DB{
+	db := &DB{
 		mu:         &sync.RWMutex{},
-		file:       bf,
+		file:       p,
+		index:      idx,
 		isOpen:     true,
 		filePath:   filePath,
+		indexType:  opts.IndexType,
 		isReadOnly: opts.ReadOnly,
-	}, nil
+		syncMode:   opts.SyncMode,
+		log:        opts.Log,
+	}
+
+	if db.syncMode == pager.SyncPeriodic && !db.isReadOnly {
+		db.stopSync = make(chan struct{})
+		db.syncDone = make(chan struct{})
+		go db.syncLoop(opts.SyncInterval)
+	}
+
+	return db, nil
 }
 
 // DB represents an instance of Kiwi database.
 type DB struct {
 	// external configs
 	filePath   string
+	indexType  IndexType
 	isReadOnly bool
+	syncMode   pager.SyncMode
+	log        func(msg string, args ...interface{})
 
 	// internal state
-	mu     *sync.RWMutex
-	file   io.BlockFile
-	isOpen bool
+	mu       *sync.RWMutex
+	file     *pager.Pager
+	index    indexer
+	isOpen   bool
+	stopSync chan struct{}
+	syncDone chan struct{}
+}
+
+// Sync flushes all the writes to the data and index files to stable
+// storage.
+func (db *DB) Sync() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.isOpen {
+		return os.ErrClosed
+	}
+	return db.sync()
 }
 
 // Close closes the underlying files and the indexers.
 func (db *DB) Close() error {
+	if db.stopSync != nil {
+		close(db.stopSync)
+		<-db.syncDone
+		db.stopSync = nil
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	db.mu.RLock()
-
 	if !db.isOpen {
 		return nil
 	}
 
+	var syncErr error
+	if db.syncMode != pager.SyncNone && !db.isReadOnly {
+		syncErr = db.file.Sync()
+	}
+
+	idxErr := db.index.Close()
 	err := db.file.Close()
 	db.isOpen = false
+	if err == nil {
+		err = idxErr
+	}
+	if err == nil {
+		err = syncErr
+	}
 	return err
 }
 
+// syncLoop syncs the data file and the index at every interval until
+// stopSync is closed.
+func (db *DB) syncLoop(interval time.Duration) {
+	defer close(db.syncDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.stopSync:
+			return
+
+		case <-ticker.C:
+			db.mu.Lock()
+			if db.isOpen {
+				if err := db.sync(); err != nil {
+					db.log("background sync failed: %v", err)
+				}
+			}
+			db.mu.Unlock()
+		}
+	}
+}
+
 func (db *DB) String() string {
-	return fmt.Sprintf("DB{file='%s', readOnly=%t}", db.filePath, db.isReadOnly)
+	return fmt.Sprintf(
+		"DB{file='%s', index=%s, readOnly=%t}",
+		db.filePath, db.indexType, db.isReadOnly,
+	)
+}
+
+// openIndex opens the index of the configured type. Index is stored in a
+// separate file next to the database file.
+func openIndex(filePath string, opts Options) (indexer, error) {
+	indexFile := filePath + ".idx"
+	if filePath == pager.InMemoryFileName {
+		indexFile = pager.InMemoryFileName
+	}
+
+	// periodic syncs of the index are driven by DB.syncLoop().
+	syncMode := opts.SyncMode
+	if syncMode == pager.SyncPeriodic {
+		syncMode = pager.SyncNone
+	}
+
+	switch opts.IndexType {
+	case BPlusTree:
+		return bptree.Open(indexFile, &bptree.Options{
+			ReadOnly:    opts.ReadOnly,
+			FileMode:    opts.FileMode,
+			PageSize:    os.Getpagesize(),
+			MaxKeySize:  defaultMaxKeySize,
+			SyncMode:    syncMode,
+			LockTimeout: opts.LockTimeout,
+			IOMode:      opts.IOMode,
+		})
+
+	case LinearHash:
+		return linearhash.Open(indexFile, &linearhash.Options{
+			ReadOnly:    opts.ReadOnly,
+			FileMode:    opts.FileMode,
+			PageSize:    os.Getpagesize(),
+			LockTimeout: opts.LockTimeout,
+			IOMode:      opts.IOMode,
+		})
+
+	case ExtHash:
+		return exthash.Open(indexFile, &exthash.Options{
+			ReadOnly:    opts.ReadOnly,
+			FileMode:    opts.FileMode,
+			PageSize:    os.Getpagesize(),
+			LockTimeout: opts.LockTimeout,
+			IOMode:      opts.IOMode,
+		})
+	}
+
+	return nil, fmt.Errorf("unsupported index type: %s", opts.IndexType)
+}
+
+// sync syncs the data file and the index. Caller must hold mu.
+func (db *DB) sync() error {
+	if err := db.file.Sync(); err != nil {
+		return err
+	}
+	return db.index.Sync()
 }
 
 func (db *DB) isMutable() bool { return db.isReadOnly || !db.isOpen }
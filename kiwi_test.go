@@ -0,0 +1,156 @@
+package kiwi
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/spy16/kiwi/index/bptree"
+	"github.com/spy16/kiwi/pager"
+)
+
+func TestOpen_IndexType(t *testing.T) {
+	for _, indexType := range []IndexType{BPlusTree, LinearHash, ExtHash} {
+		t.Run(indexType.String(), func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "kiwi.db")
+
+			opts := DefaultOptions
+			opts.IndexType = indexType
+
+			db, err := Open(filePath, &opts)
+			if err != nil {
+				t.Fatalf("Open() unexpected error: %v", err)
+			}
+
+			if err := db.index.Put([]byte("hello"), 10); err != nil {
+				t.Errorf("Put() unexpected error: %v", err)
+			}
+
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close() unexpected error: %v", err)
+			}
+
+			db, err = Open(filePath, &opts)
+			if err != nil {
+				t.Fatalf("Open() unexpected error on reopen: %v", err)
+			}
+
+			if v, err := db.index.Get([]byte("hello")); err != nil || v != 10 {
+				t.Errorf("Get() expected 10, got %d (err=%v)", v, err)
+			}
+			_ = db.Close()
+
+			opts.IndexType = (indexType + 1) % 3
+			if _, err := Open(filePath, &opts); !errors.Is(err, ErrIndexMismatch) {
+				t.Errorf("Open() expected ErrIndexMismatch, got %v", err)
+			}
+		})
+	}
+}
+
+func TestOpen_Owner(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "kiwi.db")
+
+	db, err := Open(filePath, nil)
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	if owner := db.file.Owner(); owner != pager.OwnerKiwi {
+		t.Errorf("expected data file owner %s, got %s", pager.OwnerKiwi, owner)
+	}
+	_ = db.Close()
+
+	// data file and index file must not be mistaken for each other.
+	if _, err := bptree.Open(filePath, nil); !errors.Is(err, pager.ErrOwnerMismatch) {
+		t.Errorf("bptree.Open() expected ErrOwnerMismatch, got %v", err)
+	}
+	if _, err := Open(filePath+".idx", nil); !errors.Is(err, pager.ErrOwnerMismatch) {
+		t.Errorf("Open() expected ErrOwnerMismatch for index file, got %v", err)
+	}
+}
+
+func TestOpen_IOMode(t *testing.T) {
+	for _, mode := range []pager.IOMode{pager.IOMmap, pager.IOPread, pager.IODirect} {
+		t.Run(mode.String(), func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "kiwi.db")
+
+			opts := DefaultOptions
+			opts.IOMode = mode
+
+			db, err := Open(filePath, &opts)
+			if err != nil {
+				if mode == pager.IODirect {
+					t.Skipf("skipping direct I/O: %v", err)
+				}
+				t.Fatalf("Open() unexpected error: %v", err)
+			}
+
+			if err := db.index.Put([]byte("hello"), 10); err != nil {
+				t.Errorf("Put() unexpected error: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close() unexpected error: %v", err)
+			}
+
+			// header written through the pager must survive reopen.
+			db, err = Open(filePath, &opts)
+			if err != nil {
+				t.Fatalf("Open() unexpected error on reopen: %v", err)
+			}
+			defer db.Close()
+
+			if v, err := db.index.Get([]byte("hello")); err != nil || v != 10 {
+				t.Errorf("Get() expected 10, got %d (err=%v)", v, err)
+			}
+		})
+	}
+}
+
+func TestDB_Sync(t *testing.T) {
+	for _, indexType := range []IndexType{BPlusTree, LinearHash, ExtHash} {
+		t.Run(indexType.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			filePath := filepath.Join(dir, "kiwi.db")
+
+			opts := DefaultOptions
+			opts.IndexType = indexType
+
+			db, err := Open(filePath, &opts)
+			if err != nil {
+				t.Fatalf("Open() unexpected error: %v", err)
+			}
+			defer db.Close()
+
+			if err := db.index.Put([]byte("hello"), 10); err != nil {
+				t.Errorf("Put() unexpected error: %v", err)
+			}
+			if err := db.Sync(); err != nil {
+				t.Fatalf("Sync() unexpected error: %v", err)
+			}
+
+			// copy the files without closing the database to simulate a
+			// crash right after the sync.
+			copyPath := filepath.Join(dir, "copy.db")
+			for _, suffix := range []string{"", ".idx"} {
+				d, err := ioutil.ReadFile(filePath + suffix)
+				if err != nil {
+					t.Fatalf("ReadFile() unexpected error: %v", err)
+				}
+				if err := ioutil.WriteFile(copyPath+suffix, d, 0644); err != nil {
+					t.Fatalf("WriteFile() unexpected error: %v", err)
+				}
+			}
+
+			cp, err := Open(copyPath, &opts)
+			if err != nil {
+				t.Fatalf("Open() unexpected error on copy: %v", err)
+			}
+			defer cp.Close()
+
+			if v, err := cp.index.Get([]byte("hello")); err != nil || v != 10 {
+				t.Errorf("Get() expected 10, got %d (err=%v)", v, err)
+			}
+		})
+	}
+}
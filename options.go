@@ -1,10 +1,18 @@
 package kiwi
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spy16/kiwi/pager"
+)
 
 // Indexing schemes supported.
 const (
-	BPlusTree IndexType = 0
+	BPlusTree  IndexType = 0
+	LinearHash IndexType = 1
+	ExtHash    IndexType = 2
 )
 
 // DefaultOptions provides some sane defaults for initializing Kiwi DB.
@@ -13,6 +21,7 @@ var DefaultOptions = Options{
 	ReadOnly:  false,
 	FileMode:  0664,
 	Log:       func(msg string, args ...interface{}) {},
+	SyncMode:  pager.SyncNone,
 }
 
 // Options represents configuration settings for kiwi database.
@@ -21,7 +30,33 @@ type Options struct {
 	ReadOnly  bool
 	FileMode  os.FileMode
 	Log       func(msg string, args ...interface{})
+
+	// SyncMode decides when writes are synced to stable storage. The
+	// SyncInterval applies only to pager.SyncPeriodic mode.
+	SyncMode     pager.SyncMode
+	SyncInterval time.Duration
+
+	// LockTimeout is the maximum time to wait for the locks on the data and
+	// index files held by another process. Open() fails with ErrLocked if
+	// the locks could not be acquired. If 0, fails immediately.
+	LockTimeout time.Duration
+
+	// IOMode selects how the data and index files are accessed. Defaults
+	// to pager.IOMmap.
+	IOMode pager.IOMode
 }
 
 // IndexType represents the type of the index to be used by Kiwi.
 type IndexType int
+
+func (it IndexType) String() string {
+	switch it {
+	case BPlusTree:
+		return "b+tree"
+	case LinearHash:
+		return "linearhash"
+	case ExtHash:
+		return "exthash"
+	}
+	return fmt.Sprintf("IndexType(%d)", int(it))
+}
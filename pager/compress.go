@@ -0,0 +1,343 @@
+package pager
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	// sectorSz is the unit of space allocation for compressed pages. Each
+	// compressed page occupies a sequence of sectors called an extent.
+	sectorSz = 128
+
+	// entrySz is the size of an encoded page translation table entry.
+	entrySz = 9
+
+	entryRaw = uint8(1 << 0) // page is stored uncompressed
+)
+
+// translationTable maps logical page ids to the extents holding compressed
+// pages. Logical page ids stay stable while compressed pages move between
+// extents. Pages are always written to a new extent, so the table on disk
+// keeps pointing to intact pages until it is replaced. The table is kept in
+// memory and is written to a new extent on Sync() and Close(), after which
+// the header is updated to point to it. Table is encoded in little-endian byte order
+// as below:
+//
+//	count     (4 bytes) - number of pages
+//	page0     (9 bytes) - sector (4 bytes), length (4 bytes), flags (1 byte)
+//	...
+//	freeCount (4 bytes) - number of free extents
+//	extent0   (8 bytes) - start sector (4 bytes), sectors (4 bytes)
+//	...
+type translationTable struct {
+	entries []tableEntry
+	free    []extent // free extents sorted by start sector
+	pending []extent // extents released since the table was last written
+	end     uint32   // first sector after the last allocated extent
+	dirty   bool
+}
+
+type tableEntry struct {
+	sector uint32 // first sector of the extent
+	length uint32 // size of the stored page (0 means zero page)
+	flags  uint8
+}
+
+func (e tableEntry) sectors() uint32 { return sectorsFor(int(e.length)) }
+
+type extent struct {
+	start uint32
+	count uint32
+}
+
+// alloc returns the first sector of a free extent of 'n' sectors. Extent
+// is appended to the end if no free extent is large enough.
+func (tt *translationTable) alloc(n uint32) uint32 {
+	for i, ext := range tt.free {
+		if ext.count < n {
+			continue
+		}
+
+		if ext.count == n {
+			tt.free = append(tt.free[:i], tt.free[i+1:]...)
+		} else {
+			tt.free[i] = extent{start: ext.start + n, count: ext.count - n}
+		}
+		return ext.start
+	}
+
+	start := tt.end
+	tt.end += n
+	return start
+}
+
+// release adds the extent to the free list, merging it with the adjacent
+// free extents.
+func (tt *translationTable) release(start, n uint32) {
+	if n == 0 {
+		return
+	}
+
+	i := sort.Search(len(tt.free), func(i int) bool { return tt.free[i].start > start })
+	tt.free = append(tt.free, extent{})
+	copy(tt.free[i+1:], tt.free[i:])
+	tt.free[i] = extent{start: start, count: n}
+
+	if i+1 < len(tt.free) && tt.free[i].start+tt.free[i].count == tt.free[i+1].start {
+		tt.free[i].count += tt.free[i+1].count
+		tt.free = append(tt.free[:i+1], tt.free[i+2:]...)
+	}
+
+	if i > 0 && tt.free[i-1].start+tt.free[i-1].count == tt.free[i].start {
+		tt.free[i-1].count += tt.free[i].count
+		tt.free = append(tt.free[:i], tt.free[i+1:]...)
+	}
+}
+
+// releaseLater records the extent to be released once the table on disk
+// does not refer to it anymore. See commit().
+func (tt *translationTable) releaseLater(start, n uint32) {
+	if n > 0 {
+		tt.pending = append(tt.pending, extent{start: start, count: n})
+	}
+}
+
+// commit releases the pending extents. Must be called only after the table
+// is written and the header points to it.
+func (tt *translationTable) commit() {
+	for _, ext := range tt.pending {
+		tt.release(ext.start, ext.count)
+	}
+	tt.pending = nil
+	tt.dirty = false
+}
+
+func (tt translationTable) size() int {
+	return 4 + len(tt.entries)*entrySz + 4 + len(tt.free)*8
+}
+
+func (tt translationTable) MarshalBinary() ([]byte, error) {
+	d := make([]byte, tt.size())
+	bin.PutUint32(d[0:4], uint32(len(tt.entries)))
+
+	offset := 4
+	for _, e := range tt.entries {
+		bin.PutUint32(d[offset:offset+4], e.sector)
+		bin.PutUint32(d[offset+4:offset+8], e.length)
+		d[offset+8] = e.flags
+		offset += entrySz
+	}
+
+	bin.PutUint32(d[offset:offset+4], uint32(len(tt.free)))
+	offset += 4
+	for _, ext := range tt.free {
+		bin.PutUint32(d[offset:offset+4], ext.start)
+		bin.PutUint32(d[offset+4:offset+8], ext.count)
+		offset += 8
+	}
+
+	return d, nil
+}
+
+func (tt *translationTable) UnmarshalBinary(d []byte) error {
+	if len(d) < 8 {
+		return errors.New("translation table is truncated")
+	}
+
+	count := int(bin.Uint32(d[0:4]))
+	if len(d) < 8+count*entrySz {
+		return errors.New("translation table is truncated")
+	}
+
+	tt.entries = make([]tableEntry, count)
+	offset := 4
+	for i := range tt.entries {
+		tt.entries[i] = tableEntry{
+			sector: bin.Uint32(d[offset : offset+4]),
+			length: bin.Uint32(d[offset+4 : offset+8]),
+			flags:  d[offset+8],
+		}
+		offset += entrySz
+	}
+
+	freeCount := int(bin.Uint32(d[offset : offset+4]))
+	offset += 4
+	if len(d) < offset+freeCount*8 {
+		return errors.New("translation table is truncated")
+	}
+
+	tt.free = make([]extent, freeCount)
+	for i := range tt.free {
+		tt.free[i] = extent{
+			start: bin.Uint32(d[offset : offset+4]),
+			count: bin.Uint32(d[offset+4 : offset+8]),
+		}
+		offset += 8
+	}
+
+	return nil
+}
+
+// loadTable reads the translation table pointed to by the header.
+func (p *Pager) loadTable() error {
+	p.ptt = &translationTable{end: p.header.sectors}
+	if p.header.tableLen == 0 {
+		if p.count != 0 {
+			return errors.New("translation table missing in compressed file")
+		}
+		return nil
+	}
+
+	d := make([]byte, p.header.tableLen)
+	if _, err := p.file.ReadAt(d, p.sectorOffset(p.header.tableSector)); err != nil {
+		return err
+	}
+
+	if err := p.ptt.UnmarshalBinary(d); err != nil {
+		return err
+	} else if len(p.ptt.entries) != p.count {
+		return fmt.Errorf("translation table has %d pages, header has %d", len(p.ptt.entries), p.count)
+	}
+	return nil
+}
+
+// writeTable writes the translation table to a new extent and updates the
+// header to point to it. Extents holding the previous table and the pages
+// rewritten since are released only after the header is updated.
+func (p *Pager) writeTable() error {
+	tt := p.ptt
+	if !tt.dirty {
+		return nil
+	}
+
+	// allocating the extent can only shrink the free extents, so the size
+	// before allocation is enough.
+	n := sectorsFor(tt.size())
+	sector := tt.alloc(n)
+
+	d, _ := tt.MarshalBinary()
+	if err := p.ensureSectors(); err != nil {
+		return err
+	} else if _, err := p.file.WriteAt(d, p.sectorOffset(sector)); err != nil {
+		return err
+	}
+
+	oldSector, oldLen := p.header.tableSector, p.header.tableLen
+	p.header.tableSector = sector
+	p.header.tableLen = uint32(len(d))
+	p.header.sectors = tt.end
+	if err := p.writeHeader(); err != nil {
+		return err
+	}
+
+	tt.releaseLater(oldSector, sectorsFor(int(oldLen)))
+	tt.commit()
+	return nil
+}
+
+// readCompressed reads the page with given id and decompresses it into buf.
+func (p *Pager) readCompressed(id int, buf []byte) error {
+	e := p.ptt.entries[id]
+	if e.length == 0 {
+		for i := range buf {
+			buf[i] = 0
+		}
+		p.stats.read(0)
+		return nil
+	}
+
+	d := make([]byte, e.length)
+	if _, err := p.file.ReadAt(d, p.sectorOffset(e.sector)); err != nil && err != io.EOF {
+		return err
+	}
+	p.stats.read(len(d))
+
+	if e.flags&entryRaw != 0 {
+		copy(buf, d)
+		return nil
+	}
+
+	r := flate.NewReader(bytes.NewReader(d))
+	defer r.Close()
+
+	if _, err := io.ReadFull(r, buf[:p.pageSize]); err != nil {
+		return fmt.Errorf("failed to decompress page %d: %v", id, err)
+	}
+	return nil
+}
+
+// writeCompressed compresses the page data and writes it to a new extent
+// large enough to hold it. Extent holding the previous version of the page
+// is released after the next writeTable(). Pages that do not compress are
+// stored as is and zero pages do not occupy any space.
+func (p *Pager) writeCompressed(id int, d []byte) error {
+	page := make([]byte, p.pageSize)
+	copy(page, d)
+
+	e := tableEntry{}
+	if !isZero(page) {
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+		if _, err := w.Write(page); err != nil {
+			return err
+		} else if err := w.Close(); err != nil {
+			return err
+		}
+
+		if buf.Len() < p.pageSize {
+			e.length = uint32(buf.Len())
+			page = buf.Bytes()
+		} else {
+			e.length = uint32(p.pageSize)
+			e.flags = entryRaw
+		}
+	}
+
+	tt := p.ptt
+	if e.length > 0 {
+		e.sector = tt.alloc(e.sectors())
+
+		err := p.ensureSectors()
+		if err == nil {
+			_, err = p.file.WriteAt(page[:e.length], p.sectorOffset(e.sector))
+		}
+		if err != nil {
+			tt.release(e.sector, e.sectors())
+			return err
+		}
+	}
+
+	old := tt.entries[id]
+	tt.releaseLater(old.sector, old.sectors())
+	tt.entries[id] = e
+	tt.dirty = true
+	p.stats.write(int(e.length))
+	return nil
+}
+
+// ensureSectors grows the file if the sectors allocated exceed the file.
+func (p *Pager) ensureSectors() error {
+	if required := p.sectorOffset(p.ptt.end); required > p.fileSize {
+		return p.grow(required)
+	}
+	return nil
+}
+
+// sectorOffset returns the file offset of the sector. Sectors are stored
+// after the header page.
+func (p *Pager) sectorOffset(sector uint32) int64 {
+	return int64(p.pageSize) + int64(sector)*sectorSz
+}
+
+func sectorsFor(length int) uint32 {
+	return uint32((length + sectorSz - 1) / sectorSz)
+}
+
+func isZero(d []byte) bool {
+	return len(d) == 0 || (d[0] == 0 && bytes.Equal(d, make([]byte, len(d))))
+}
@@ -0,0 +1,139 @@
+package pager
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+const (
+	nonceSz = 12 // standard AES-GCM nonce size
+	tagSz   = 16 // AES-GCM authentication tag size
+
+	// sealOverhead is the number of extra bytes required to store a page
+	// encrypted. Each encrypted page is stored as nonce, ciphertext and tag.
+	sealOverhead = nonceSz + tagSz
+
+	keyCheckSz = nonceSz + len(keyCheckText) + tagSz
+)
+
+// keyCheckText is sealed with the encryption key and stored in the pager
+// header to verify the key when the file is opened.
+const keyCheckText = "kiwi-pager-keychk"
+
+var (
+	// ErrWrongKey is returned when an encrypted file is opened with a key
+	// that is different from the one it was created with.
+	ErrWrongKey = errors.New("encryption key does not match the file")
+
+	// ErrKeyRequired is returned when an encrypted file is opened without
+	// an encryption key.
+	ErrKeyRequired = errors.New("file is encrypted, encryption key required")
+)
+
+// newCipher returns AES-GCM cipher for the key. Key must be 16, 24 or 32
+// bytes to select AES-128, AES-192 or AES-256.
+func newCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealKeyCheck returns the key check block for the header.
+func sealKeyCheck(aead cipher.AEAD) ([]byte, error) {
+	d := make([]byte, nonceSz, keyCheckSz)
+	if _, err := io.ReadFull(rand.Reader, d); err != nil {
+		return nil, err
+	}
+	return aead.Seal(d, d, []byte(keyCheckText), headerAAD()), nil
+}
+
+// verifyKeyCheck returns ErrWrongKey if the key check block in the header
+// was not sealed with the same key.
+func verifyKeyCheck(aead cipher.AEAD, d []byte) error {
+	pt, err := aead.Open(nil, d[:nonceSz], d[nonceSz:keyCheckSz], headerAAD())
+	if err != nil || string(pt) != keyCheckText {
+		return ErrWrongKey
+	}
+	return nil
+}
+
+// readSealed reads the encrypted page with given id and decrypts it into
+// 'buf'. Every allocated page is sealed by Alloc(), so a slot that fails
+// authentication (including an all-zero slot) is reported as corrupted.
+func (p *Pager) readSealed(id int, buf []byte) error {
+	slot := make([]byte, p.slotSize())
+	n, err := p.file.ReadAt(slot, p.offset(id))
+	if n < len(slot) {
+		return io.EOF
+	} else if err != nil && err != io.EOF {
+		return err
+	}
+	p.stats.read(len(slot))
+
+	_, err = p.aead.Open(buf[:0], slot[:nonceSz], slot[nonceSz:], pageAAD(id))
+	if err != nil {
+		return errors.New("failed to decrypt page, data is corrupted or tampered")
+	}
+	return nil
+}
+
+// writeSealed encrypts the page data with a new random nonce and writes it
+// to the page with given id. Data smaller than a page is zero padded.
+func (p *Pager) writeSealed(id int, d []byte) error {
+	page := make([]byte, p.pageSize)
+	copy(page, d)
+
+	slot := make([]byte, nonceSz, p.slotSize())
+	if _, err := io.ReadFull(rand.Reader, slot); err != nil {
+		return err
+	}
+	slot = p.aead.Seal(slot, slot, page, pageAAD(id))
+
+	if _, err := p.file.WriteAt(slot, p.offset(id)); err != nil {
+		return err
+	}
+	p.stats.write(len(slot))
+	return nil
+}
+
+// sealZero writes sealed zero pages to the 'n' slots starting at the page
+// with given id using a single write. Used to initialize new pages, so that
+// unwritten pages are authenticated just like the written ones.
+func (p *Pager) sealZero(id, n int) error {
+	page := make([]byte, p.pageSize)
+	slotSz := p.slotSize()
+
+	run := make([]byte, 0, n*slotSz)
+	for i := 0; i < n; i++ {
+		slot := run[len(run) : len(run)+nonceSz]
+		if _, err := io.ReadFull(rand.Reader, slot); err != nil {
+			return err
+		}
+		run = p.aead.Seal(run[:len(run)+nonceSz], slot, page, pageAAD(id+i))
+	}
+
+	if _, err := p.file.WriteAt(run, p.offset(id)); err != nil {
+		return err
+	}
+	p.stats.writeMany(n, len(run))
+	return nil
+}
+
+// pageAAD binds the ciphertext to the page id so that pages cannot be
+// swapped around in the file without detection.
+func pageAAD(id int) []byte {
+	d := make([]byte, 8)
+	bin.PutUint64(d, uint64(id))
+	return d
+}
+
+func headerAAD() []byte {
+	d := make([]byte, 4)
+	bin.PutUint32(d, magic)
+	return d
+}
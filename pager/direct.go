@@ -0,0 +1,47 @@
+package pager
+
+import (
+	"io"
+
+	"github.com/spy16/kiwi/internal/fileutil"
+)
+
+// directAlignment is the alignment of buffers, offsets and sizes required
+// for direct I/O. Page size must be a multiple of this in IODirect mode.
+const directAlignment = fileutil.DirectAlignment
+
+// readAt reads from the file at given offset. With direct I/O, the read is
+// done into an aligned buffer rounded up to the alignment and copied.
+func (p *Pager) readAt(d []byte, off int64) (int, error) {
+	if !p.direct {
+		return p.file.ReadAt(d, off)
+	}
+
+	buf := fileutil.AlignedBuffer(fileutil.AlignUp(len(d)))
+	n, err := p.file.ReadAt(buf, off)
+	if n > len(d) {
+		n = len(d)
+	}
+	copy(d, buf[:n])
+
+	if n == len(d) && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// writeAt writes to the file at given offset. With direct I/O, the data is
+// copied into an aligned buffer zero padded to the alignment, so the write
+// may zero the bytes following the data up to the next aligned offset.
+func (p *Pager) writeAt(d []byte, off int64) (int, error) {
+	if !p.direct {
+		return p.file.WriteAt(d, off)
+	}
+
+	buf := fileutil.AlignedBuffer(fileutil.AlignUp(len(d)))
+	copy(buf, d)
+	if _, err := p.file.WriteAt(buf, off); err != nil {
+		return 0, err
+	}
+	return len(d), nil
+}
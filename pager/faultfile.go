@@ -0,0 +1,192 @@
+package pager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var _ RandomAccessFile = (*FaultFile)(nil)
+
+// ErrCrashed is returned by FaultFile for the operations attempted after the
+// simulated crash.
+var ErrCrashed = errors.New("simulated crash")
+
+// NewFaultFile returns an in-memory FaultFile with the given initial image.
+// The image is copied.
+func NewFaultFile(name string, image []byte) *FaultFile {
+	return &FaultFile{
+		name:    name,
+		data:    append([]byte(nil), image...),
+		crashAt: -1,
+	}
+}
+
+// FaultFile is an in-memory RandomAccessFile for crash-consistency testing.
+// Every WriteAt() and Truncate() is recorded as an operation. FaultFile can
+// be set to crash at an operation, after which the operation is dropped or
+// torn, and all the later mutations fail with ErrCrashed. The surviving
+// image can then be opened again using NewFaultFile(). Use OpenFile() to
+// create a pager on a FaultFile.
+type FaultFile struct {
+	mu      sync.Mutex
+	name    string
+	data    []byte
+	ops     []FaultOp
+	crashAt int
+	tear    int
+	crashed bool
+	closed  bool
+}
+
+// FaultOp represents a mutation recorded by FaultFile.
+type FaultOp struct {
+	Truncate bool  // true for Truncate(), false for WriteAt()
+	Offset   int64 // offset of the write
+	Size     int64 // size of the write or the new size of the file
+}
+
+func (op FaultOp) String() string {
+	if op.Truncate {
+		return fmt.Sprintf("truncate(%d)", op.Size)
+	}
+	return fmt.Sprintf("write(off=%d, size=%d)", op.Offset, op.Size)
+}
+
+// CrashAt sets the file to crash at the n-th (0-based) operation. If the
+// operation is a write, only the first 'tear' bytes of it are applied (none
+// if 'tear' <= 0). Truncate at the crash point is dropped.
+func (f *FaultFile) CrashAt(n, tear int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.crashAt = n
+	f.tear = tear
+}
+
+// Crashed returns true if the simulated crash has happened.
+func (f *FaultFile) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.crashed
+}
+
+// Ops returns the operations recorded so far, including the one at the
+// crash point.
+func (f *FaultFile) Ops() []FaultOp {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FaultOp(nil), f.ops...)
+}
+
+// Image returns a copy of the file contents that survived.
+func (f *FaultFile) Image() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]byte(nil), f.data...)
+}
+
+func (f *FaultFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	} else if off < 0 {
+		return 0, errors.New("negative offset")
+	} else if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *FaultFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	} else if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	atCrash, err := f.record(FaultOp{Offset: off, Size: int64(len(p))})
+	if err != nil {
+		if atCrash && f.tear > 0 {
+			torn := p
+			if f.tear < len(torn) {
+				torn = torn[:f.tear]
+			}
+			f.apply(torn, off)
+		}
+		return 0, err
+	}
+
+	f.apply(p, off)
+	return len(p), nil
+}
+
+func (f *FaultFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	if _, err := f.record(FaultOp{Truncate: true, Size: size}); err != nil {
+		return err
+	}
+	f.resize(size)
+	return nil
+}
+
+// Close marks the file closed. Image() remains available.
+func (f *FaultFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *FaultFile) Name() string { return f.name }
+
+func (f *FaultFile) Size() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return int64(len(f.data))
+}
+
+// record records the operation and returns ErrCrashed if the operation must
+// not be applied. 'atCrash' is true if the operation is the crash point.
+func (f *FaultFile) record(op FaultOp) (atCrash bool, err error) {
+	if f.crashed {
+		return false, ErrCrashed
+	}
+
+	f.ops = append(f.ops, op)
+	if len(f.ops)-1 == f.crashAt {
+		f.crashed = true
+		return true, ErrCrashed
+	}
+	return false, nil
+}
+
+func (f *FaultFile) apply(p []byte, off int64) {
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.resize(end)
+	}
+	copy(f.data[off:], p)
+}
+
+func (f *FaultFile) resize(size int64) {
+	d := make([]byte, size)
+	copy(d, f.data)
+	f.data = d
+}
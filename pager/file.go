@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"os"
+	"sync"
 )
 
 var (
@@ -22,19 +23,28 @@ type RandomAccessFile interface {
 	Name() string
 }
 
+type syncer interface {
+	Sync() error
+}
+
 type sizedFile interface {
 	RandomAccessFile
 	Size() int64
 }
 
-// inMemory implements an in-memory random access file.
+// inMemory implements an in-memory random access file. inMemory is safe for
+// concurrent use.
 type inMemory struct {
+	mu       sync.RWMutex
 	closed   bool
 	data     []byte
 	readOnly bool
 }
 
 func (mem *inMemory) ReadAt(p []byte, off int64) (n int, err error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
 	if len(p) == 0 {
 		return 0, nil
 	} else if off < 0 {
@@ -53,6 +63,9 @@ func (mem *inMemory) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 func (mem *inMemory) WriteAt(p []byte, off int64) (n int, err error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
 	if len(p) == 0 {
 		return 0, nil
 	} else if off < 0 {
@@ -67,7 +80,7 @@ func (mem *inMemory) WriteAt(p []byte, off int64) (n int, err error) {
 
 	spaceRequired := off + int64(len(p))
 	if int(spaceRequired) > len(mem.data) {
-		_ = mem.Truncate(spaceRequired)
+		_ = mem.truncate(spaceRequired)
 	}
 
 	n = copy(mem.data[off:], p)
@@ -75,12 +88,21 @@ func (mem *inMemory) WriteAt(p []byte, off int64) (n int, err error) {
 }
 
 func (mem *inMemory) Close() error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
 	mem.closed = true
 	mem.data = nil
 	return nil
 }
 
 func (mem *inMemory) Truncate(size int64) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	return mem.truncate(size)
+}
+
+func (mem *inMemory) truncate(size int64) error {
 	d := mem.data
 	mem.data = make([]byte, size)
 	copy(mem.data, d)
@@ -88,6 +110,8 @@ func (mem *inMemory) Truncate(size int64) error {
 }
 
 func (mem *inMemory) Size() int64 {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
 	return int64(len(mem.data))
 }
 
@@ -0,0 +1,165 @@
+package pager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// magic marker to indicate a file managed by pager.
+	// hex version of 'kpgr'
+	magic   = uint32(0x6B706772)
+	version = uint8(0x1)
+
+	headerSz = 96
+
+	// flagEncrypted indicates that all pages except the header page are
+	// encrypted.
+	flagEncrypted = uint8(1 << 0)
+
+	// flagCompressed indicates that pages are compressed and stored in
+	// extents mapped by the translation table.
+	flagCompressed = uint8(1 << 1)
+)
+
+// ErrNoHeader is returned when opening a non-empty file that does not have
+// the pager header. Such files can be converted using Migrate().
+var ErrNoHeader = errors.New("pager header not found")
+
+// ErrOwnerMismatch is returned when opening a file created by a different
+// owner than the one in Options.
+var ErrOwnerMismatch = errors.New("file is owned by a different index type")
+
+// Owner identifies the type of the file stored using the pager, so that a
+// file is not opened as a different index type.
+type Owner uint8
+
+// Owners known to the pager.
+const (
+	OwnerNone       Owner = iota // owner not recorded
+	OwnerBPlusTree               // B+ tree index
+	OwnerLinearHash              // linear hashing index
+	OwnerExtHash                 // extendible hashing index
+	OwnerKiwi                    // kiwi database file
+)
+
+func (o Owner) String() string {
+	switch o {
+	case OwnerNone:
+		return "none"
+	case OwnerBPlusTree:
+		return "bptree"
+	case OwnerLinearHash:
+		return "linearhash"
+	case OwnerExtHash:
+		return "exthash"
+	case OwnerKiwi:
+		return "kiwi"
+	}
+	return fmt.Sprintf("Owner(%d)", int(o))
+}
+
+// bin is the byte order used for the pager header and free pages.
+var bin = binary.LittleEndian
+
+// header is stored at the beginning of the first physical page of the file
+// and is never visible to the users of pager. All fields are encoded in
+// little-endian byte order.
+//
+//	magic    (4 bytes) - magic marker 'kpgr'
+//	version  (1 byte)  - version of the pager file layout
+//	flags    (1 byte)  - control flags
+//	reserved (2 bytes)
+//	pageSz   (4 bytes) - page size used to create the file
+//	free     (4 bytes) - first page in the free list (0 means none)
+//	count    (4 bytes) - number of pages allocated (excluding header page)
+//	keyCheck (45 bytes) - sealed key check block for encrypted files
+//	reserved (3 bytes)
+//	tableSec (4 bytes) - first sector of the translation table (compressed)
+//	tableLen (4 bytes) - size of the translation table (compressed)
+//	sectors  (4 bytes) - number of sectors allocated (compressed)
+//	owner    (1 byte)  - type of the file stored using the pager
+//	reserved (7 bytes)
+//	ctime    (8 bytes) - creation time in unix nanoseconds
+//
+// Free pages are linked together using the first 4 bytes of the page which
+// holds the next free page. Page ids in the free list are physical ids, so
+// that 0 can be used as the end of the list.
+type header struct {
+	magic    uint32
+	version  uint8
+	flags    uint8
+	pageSz   uint32
+	free     uint32
+	count    uint32
+	keyCheck []byte
+
+	// state of the compressed files
+	tableSector uint32
+	tableLen    uint32
+	sectors     uint32
+
+	owner Owner
+	ctime int64
+}
+
+func (h header) validate() error {
+	if h.magic != magic {
+		return ErrNoHeader
+	} else if h.version != version {
+		return fmt.Errorf("incompatible pager version %#x (expected: %#x)", h.version, version)
+	} else if h.flags&^(flagEncrypted|flagCompressed) != 0 {
+		return fmt.Errorf("unknown flags %#x in pager header", h.flags)
+	} else if int(h.pageSz) < headerSz {
+		return fmt.Errorf("invalid page size %d in pager header", h.pageSz)
+	} else if h.owner > OwnerKiwi {
+		return fmt.Errorf("unknown owner %d in pager header", h.owner)
+	}
+	return nil
+}
+
+func (h header) created() time.Time {
+	if h.ctime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, h.ctime)
+}
+
+func (h header) MarshalBinary() ([]byte, error) {
+	d := make([]byte, headerSz)
+	bin.PutUint32(d[0:4], h.magic)
+	d[4] = h.version
+	d[5] = h.flags
+	bin.PutUint32(d[8:12], h.pageSz)
+	bin.PutUint32(d[12:16], h.free)
+	bin.PutUint32(d[16:20], h.count)
+	copy(d[20:20+keyCheckSz], h.keyCheck)
+	bin.PutUint32(d[68:72], h.tableSector)
+	bin.PutUint32(d[72:76], h.tableLen)
+	bin.PutUint32(d[76:80], h.sectors)
+	d[80] = uint8(h.owner)
+	bin.PutUint64(d[88:96], uint64(h.ctime))
+	return d, nil
+}
+
+func (h *header) UnmarshalBinary(d []byte) error {
+	if len(d) < headerSz {
+		return fmt.Errorf("need at-least %d bytes, got only %d", headerSz, len(d))
+	}
+
+	h.magic = bin.Uint32(d[0:4])
+	h.version = d[4]
+	h.flags = d[5]
+	h.pageSz = bin.Uint32(d[8:12])
+	h.free = bin.Uint32(d[12:16])
+	h.count = bin.Uint32(d[16:20])
+	h.keyCheck = append([]byte(nil), d[20:20+keyCheckSz]...)
+	h.tableSector = bin.Uint32(d[68:72])
+	h.tableLen = bin.Uint32(d[72:76])
+	h.sectors = bin.Uint32(d[76:80])
+	h.owner = Owner(d[80])
+	h.ctime = int64(bin.Uint64(d[88:96]))
+	return nil
+}
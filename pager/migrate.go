@@ -0,0 +1,87 @@
+package pager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spy16/kiwi/internal/fileutil"
+)
+
+// Migrate converts a file written before the pager header was introduced
+// into the current layout in-place. All pages are moved one page forward
+// and the header is written into the first page, so page ids seen by the
+// users of pager remain the same. Migrating an empty file or a file that
+// already has the header is a no-op. Migration is not crash-safe, so the
+// file should be backed up before.
+func Migrate(fileName string, pageSize int) error {
+	if pageSize < headerSz {
+		return fmt.Errorf("invalid page size %d", pageSize)
+	}
+
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := fileutil.Lock(f, true, 0); err != nil {
+		return err
+	}
+
+	size, err := findSize(f)
+	if err != nil {
+		return err
+	} else if size == 0 {
+		return nil
+	}
+
+	d := make([]byte, headerSz)
+	if _, err := f.ReadAt(d, 0); err != nil && err != io.EOF {
+		return err
+	}
+
+	h := header{}
+	if err := h.UnmarshalBinary(d); err == nil && h.magic == magic {
+		return h.validate()
+	}
+
+	if size%int64(pageSize) != 0 {
+		return errors.New("file size is not a multiple of page size")
+	}
+
+	if err := f.Truncate(size + int64(pageSize)); err != nil {
+		return err
+	}
+
+	// move pages starting from the last one so that no page is overwritten
+	// before it is moved.
+	buf := make([]byte, pageSize)
+	for off := size - int64(pageSize); off >= 0; off -= int64(pageSize) {
+		if _, err := f.ReadAt(buf, off); err != nil {
+			return err
+		}
+
+		if _, err := f.WriteAt(buf, off+int64(pageSize)); err != nil {
+			return err
+		}
+	}
+
+	h = header{
+		magic:   magic,
+		version: version,
+		pageSz:  uint32(pageSize),
+		count:   uint32(size / int64(pageSize)),
+	}
+	d, _ = h.MarshalBinary()
+	for i := range buf {
+		buf[i] = 0
+	}
+	copy(buf, d)
+	if _, err := f.WriteAt(buf, 0); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
@@ -0,0 +1,57 @@
+package pager
+
+import (
+	"os"
+	"time"
+)
+
+var defaultOptions = Options{
+	ReadOnly: false,
+	FileMode: 0644,
+}
+
+// Options can be provided to Open() to configure the pager.
+type Options struct {
+	ReadOnly bool
+	FileMode os.FileMode
+
+	// PageSize to be used for file I/O. If 0, page size of an existing file
+	// is read from the pager header and new files use os.Getpagesize().
+	PageSize int
+
+	// GrowthChunk is the maximum number of bytes the file is grown by when
+	// more pages are required. File size is doubled on every growth until
+	// the growth reaches this limit, after which the file grows in chunks of
+	// this size. Set to the page size to grow exactly as required. Defaults
+	// to 64 MiB.
+	GrowthChunk int64
+
+	// EncryptionKey enables encryption of pages at rest using AES-GCM. Key
+	// must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256. Key
+	// is verified against the file header when opening an existing file.
+	// Memory mapping is not used for encrypted files.
+	EncryptionKey []byte
+
+	// Compression enables compression of pages using flate. Compressed
+	// pages are packed into the file and located using a translation table
+	// which is persisted on Sync() and Close(). Applies only to new files,
+	// existing files are opened in the mode they were created with. Cannot
+	// be combined with encryption. Memory mapping is not used for
+	// compressed files.
+	Compression bool
+
+	// LockTimeout is the maximum time to wait for the file lock held by
+	// another pager. Writers take an exclusive lock and readers take a
+	// shared lock. If 0, Open() fails with ErrLocked immediately.
+	LockTimeout time.Duration
+
+	// Owner is recorded in the header of new files. Opening a file recorded
+	// with a different owner fails with ErrOwnerMismatch. Files without an
+	// owner are claimed when opened for writing. OwnerNone skips the check.
+	Owner Owner
+
+	// IOMode selects the code path used for page I/O. Defaults to IOMmap.
+	// Memory mapping is never used for encrypted, compressed or in-memory
+	// files regardless of the mode.
+	IOMode IOMode
+}
@@ -1,17 +1,21 @@
 package pager
 
 import (
+	"crypto/cipher"
 	"encoding"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/edsrzf/mmap-go"
+	"github.com/spy16/kiwi/internal/fileutil"
 )
 
-const disableMmap = false
-
 // InMemoryFileName can be passed to Open() to create a pager for an ephemeral
 // in-memory file.
 const InMemoryFileName = ":memory:"
@@ -20,39 +24,77 @@ const InMemoryFileName = ":memory:"
 // pager instance.
 var ErrReadOnly = errors.New("read-only")
 
+// ErrLocked is returned by Open() when the file is locked by another pager
+// (in this or another process) and the lock could not be acquired within the
+// LockTimeout.
+var ErrLocked = fileutil.ErrLocked
+
 // Open opens the named file and returns a pager instance for it. If the file
-// doesn't exist, it will be created if not in read-only mode.
-func Open(fileName string, blockSz int, readOnly bool, mode os.FileMode) (*Pager, error) {
-	if fileName == InMemoryFileName {
-		return newPager(&inMemory{}, blockSz, readOnly, 0)
+// doesn't exist, it will be created if not in read-only mode. File is locked
+// for the lifetime of the pager, exclusively unless opened in read-only
+// mode. If 'opts' is nil, uses default options.
+func Open(fileName string, opts *Options) (*Pager, error) {
+	if opts == nil {
+		opts = &defaultOptions
 	}
 
-	// if blockSz == 0 {
-	// 	blockSz = os.Getpagesize()
-	// } else if blockSz < 4096 || blockSz%4096 != 0 {
-	// 	return nil, errors.New("block size must be multple of 4096")
-	// }
+	if fileName == InMemoryFileName {
+		return newPager(&inMemory{}, *opts, 0)
+	}
 
 	mmapFlag := mmap.RDWR
 	flag := os.O_CREATE | os.O_RDWR
-	if readOnly {
+	if opts.ReadOnly {
 		mmapFlag = mmap.RDONLY
 		flag = os.O_RDONLY
 	}
 
-	f, err := os.OpenFile(fileName, flag, mode)
+	switch opts.IOMode {
+	case IOMmap, IOPread:
+	case IODirect:
+		if fileutil.DirectFlag == 0 {
+			return nil, errors.New("direct I/O is not supported on this platform")
+		}
+		flag |= fileutil.DirectFlag
+	default:
+		return nil, fmt.Errorf("invalid I/O mode %s", opts.IOMode)
+	}
+
+	f, err := os.OpenFile(fileName, flag, opts.FileMode)
 	if err != nil {
 		return nil, err
 	}
 
-	return newPager(f, blockSz, readOnly, mmapFlag)
+	if err := fileutil.Lock(f, !opts.ReadOnly, opts.LockTimeout); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return newPager(f, *opts, mmapFlag)
+}
+
+// OpenFile returns a pager instance for the given random access file. The
+// file is not locked and memory mapping is used only for os.File. Pager
+// takes ownership of the file and closes it on Close(). If 'opts' is nil,
+// uses default options.
+func OpenFile(file RandomAccessFile, opts *Options) (*Pager, error) {
+	if opts == nil {
+		opts = &defaultOptions
+	}
+
+	mmapFlag := mmap.RDWR
+	if opts.ReadOnly {
+		mmapFlag = mmap.RDONLY
+	}
+	return newPager(file, *opts, mmapFlag)
 }
 
 // newPager creates an instance of pager for given random access file object.
 // By default page size is set to the current system page size.
-func newPager(file RandomAccessFile, pageSize int, readOnly bool, mmapFlag int) (*Pager, error) {
+func newPager(file RandomAccessFile, opts Options, mmapFlag int) (*Pager, error) {
 	size, err := findSize(file)
 	if err != nil {
+		_ = file.Close()
 		return nil, err
 	}
 
@@ -61,14 +103,24 @@ func newPager(file RandomAccessFile, pageSize int, readOnly bool, mmapFlag int)
 	p := &Pager{
 		file:     file,
 		fileSize: size,
-		readOnly: readOnly,
-		pageSize: pageSize,
+		readOnly: opts.ReadOnly,
 		osFile:   osFile,
 		mmapFlag: mmapFlag,
+		growth:   opts.GrowthChunk,
+		ioMode:   opts.IOMode,
+		direct:   opts.IOMode == IODirect && osFile != nil,
+	}
+
+	if p.growth <= 0 {
+		p.growth = fileutil.DefaultGrowthChunk
+	}
+
+	if err := p.init(opts); err != nil {
+		_ = p.Close()
+		return nil, err
 	}
-	p.computeCount()
 
-	if size > 0 {
+	if p.fileSize > 0 {
 		if err := p.mmap(); err != nil {
 			_ = p.Close()
 			return nil, err
@@ -80,104 +132,519 @@ func newPager(file RandomAccessFile, pageSize int, readOnly bool, mmapFlag int)
 
 // Pager provides facilities for paged I/O on file-like objects with random
 // access. If the underlying file is os.File type, memory mapping will be
-// enabled when file size is non-zero.
+// enabled when file size is non-zero unless a different IOMode is selected.
+// The file is grown ahead of the pages handed out by Alloc() and a region
+// larger than the file is mapped, so that most allocations neither resize
+// the file nor remap it. Pager is safe for concurrent use, but concurrent
+// writes to the same page are not ordered.
 type Pager struct {
+	// i/o tracking, kept first for 64-bit alignment.
+	stats counters
+
+	// mu is held shared for page reads and writes, and exclusively while
+	// allocating, remapping or closing, so that a remap never unmaps the
+	// region under a reader (including the slices exposed by View()).
+	mu sync.RWMutex
+
 	// internal states
 	file     RandomAccessFile
 	pageSize int
-	fileSize int64
-	count    int
+	fileSize int64 // size of the file including the pre-allocated space
+	growth   int64 // max number of bytes to grow the file by at a time
+	count    int   // number of pages handed out by Alloc()
 	readOnly bool
+	header   header
+	aead     cipher.AEAD       // set only if pages are encrypted
+	ptt      *translationTable // set only if pages are compressed
 
-	// memory mapping state for os.File
+	// memory mapping state for os.File.
 	osFile   *os.File
 	data     mmap.MMap
+	mapSize  int64
 	mmapFlag int
 
-	// i/o tracking
-	writes int
-	reads  int
-	allocs int
+	// ioMode selects the code path for page I/O. direct is set if the file
+	// is opened for direct I/O and requires aligned buffers.
+	ioMode IOMode
+	direct bool
+
+	// buffer pool used by Pin() and Unpin(). pool must not be called
+	// while holding mu since the pool calls back into its pagers.
+	pool *Pool
 }
 
 // Alloc allocates 'n' new sequential pages and returns the id of the first
-// page in sequence.
+// page in sequence. Single page allocations reuse pages from the free list
+// if available. New pages are always zeroed.
 func (p *Pager) Alloc(n int) (int, error) {
+	defer p.stats.allocLatency.since(time.Now())
+
+	id, reused, err := p.alloc(n)
+	if err == nil && reused {
+		// pool may still hold the page from before it was freed.
+		if pool := p.getPool(); pool != nil {
+			pool.update(p, id, nil)
+		}
+	}
+	return id, err
+}
+
+// Free releases the pages with given ids to the free list to be reused by
+// Alloc(). Pages must not be used after they are freed and must not be freed
+// more than once. Returns ErrPinned if any of the pages is pinned.
+func (p *Pager) Free(ids ...int) error {
+	pool := p.getPool()
+	if pool != nil && pool.pinned(p, ids...) {
+		return ErrPinned
+	}
+
+	freed, err := p.free(ids)
+	if pool != nil {
+		for id, d := range freed {
+			pool.update(p, id, d)
+		}
+	}
+	return err
+}
+
+func (p *Pager) alloc(n int) (id int, reused bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	if p.file == nil {
-		return 0, os.ErrClosed
+		return 0, false, os.ErrClosed
 	} else if p.readOnly {
-		return 0, ErrReadOnly
+		return 0, false, ErrReadOnly
+	} else if n <= 0 {
+		return 0, false, errors.New("page count must be positive")
+	}
+
+	if n == 1 && p.header.free != 0 {
+		id, err := p.allocFree()
+		return id, err == nil, err
 	}
 
 	nextID := p.count
+	if p.ptt != nil {
+		// compressed pages do not occupy space until written.
+		p.ptt.entries = append(p.ptt.entries, make([]tableEntry, n)...)
+		p.ptt.dirty = true
+	} else if required := p.offset(nextID + n); required > p.fileSize {
+		if err := p.grow(required); err != nil {
+			return 0, false, err
+		}
+	}
 
-	_ = p.unmap()
-	targetSize := p.fileSize + int64(n*p.pageSize)
-	if err := p.file.Truncate(targetSize); err != nil {
-		return 0, err
+	if p.aead != nil {
+		if err := p.sealZero(nextID, n); err != nil {
+			return 0, false, err
+		}
+	}
+
+	p.count += n
+	p.header.count = uint32(p.count)
+	atomic.AddInt64(&p.stats.allocs, 1)
+	return nextID, false, p.updateHeader()
+}
+
+// free links the pages into the free list and returns the data written to
+// the freed pages.
+func (p *Pager) free(ids []int) (map[int][]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.file == nil {
+		return nil, os.ErrClosed
+	} else if p.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	freed := map[int][]byte{}
+	for _, id := range ids {
+		if id < 0 || id >= p.count {
+			return freed, fmt.Errorf("invalid page id=%d (max=%d)", id, p.count-1)
+		}
+
+		d := make([]byte, p.pageSize)
+		bin.PutUint32(d[0:4], p.header.free)
+		if err := p.writePage(id, d); err != nil {
+			return freed, err
+		}
+		freed[id] = d
+
+		p.header.free = uint32(id + 1)
+		atomic.AddInt64(&p.stats.frees, 1)
 	}
 
-	p.fileSize = targetSize
-	p.computeCount()
+	return freed, p.updateHeader()
+}
 
-	p.allocs++
-	return nextID, p.mmap()
+// load reads the page into 'buf' holding mu as required. Used by the
+// public API and the buffer pool.
+func (p *Pager) load(id int, buf []byte) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.readPage(id, buf)
 }
 
-// Read reads one page of data from the underlying file or mmapped region if
-// enabled.
-func (p *Pager) Read(id int) ([]byte, error) {
-	if id < 0 || id >= p.count {
-		return nil, fmt.Errorf("invalid page id (max=%d)", id)
+// store writes the page holding mu as required. Writing a compressed page
+// updates the translation table and may grow the file, which requires
+// exclusive access.
+func (p *Pager) store(id int, d []byte) error {
+	if p.ptt != nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+	} else {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+	}
+	return p.writePage(id, d)
+}
+
+// loadRange reads the sequential pages into 'buf' holding mu.
+func (p *Pager) loadRange(start, n int, buf []byte) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if start < 0 || start+n > p.count {
+		return fmt.Errorf("invalid page range [%d, %d) (max=%d)", start, start+n, p.count-1)
 	} else if p.file == nil {
-		return nil, os.ErrClosed
+		return os.ErrClosed
 	}
 
-	buf := make([]byte, p.pageSize)
+	// encrypted and compressed pages are stored individually.
+	if p.aead != nil || p.ptt != nil {
+		for i := 0; i < n; i++ {
+			if err := p.readPage(start+i, buf[i*p.pageSize:(i+1)*p.pageSize]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var read int
+	var err error
 	if p.data != nil {
-		n := copy(buf, p.data[p.offset(id):])
-		if n < p.pageSize {
-			return nil, io.EOF
+		read = copy(buf, p.data[p.offset(start):])
+	} else {
+		read, err = p.readAt(buf, p.offset(start))
+	}
+
+	if read < len(buf) {
+		return io.EOF
+	}
+	p.stats.readMany(n, read)
+	return err
+}
+
+// storeMany writes the pages with the sorted ids holding mu as required.
+// Runs of contiguous ids are written at once.
+func (p *Pager) storeMany(ids []int, pages map[int][]byte) error {
+	if p.ptt != nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+	} else {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+	}
+
+	if p.file == nil {
+		return os.ErrClosed
+	} else if p.readOnly {
+		return ErrReadOnly
+	}
+
+	for _, id := range ids {
+		if id < 0 || id >= p.count {
+			return fmt.Errorf("invalid page id=%d (max=%d)", id, p.count-1)
+		}
+	}
+
+	if p.aead != nil || p.ptt != nil {
+		for _, id := range ids {
+			if err := p.writePage(id, pages[id]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i := 0; i < len(ids); {
+		j := i + 1
+		for j < len(ids) && ids[j] == ids[j-1]+1 {
+			j++
+		}
+
+		run := make([]byte, (j-i)*p.pageSize)
+		for k, id := range ids[i:j] {
+			copy(run[k*p.pageSize:], pages[id])
 		}
-		p.reads++
+
+		if p.data != nil {
+			copy(p.data[p.offset(ids[i]):], run)
+		} else if _, err := p.writeAt(run, p.offset(ids[i])); err != nil {
+			return err
+		}
+		p.stats.writeMany(j-i, len(run))
+		i = j
+	}
+	return nil
+}
+
+func (p *Pager) getPool() *Pool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pool
+}
+
+// Read reads one page of data from the underlying file or mmapped region if
+// enabled. If the page is in the buffer pool, the cached copy is returned.
+func (p *Pager) Read(id int) ([]byte, error) {
+	defer p.stats.readLatency.since(time.Now())
+
+	buf := make([]byte, p.pageSize)
+	if pool := p.getPool(); pool != nil && pool.read(p, id, buf) {
 		return buf, nil
 	}
 
-	n, err := p.file.ReadAt(buf, p.offset(id))
-	if n < p.pageSize {
-		return nil, io.EOF
+	if err := p.load(id, buf); err != nil {
+		return nil, err
 	}
-	p.reads++
-	return buf, err
+	return buf, nil
 }
 
-// Write writes one page of data to the page with given id. Returns error if
-// the data is larger than a page.
-func (p *Pager) Write(id int, d []byte) error {
+// View calls 'fn' with the data of the page with given id. If memory mapping
+// is enabled, the mapped region is exposed directly without copying. The
+// slice is valid only within 'fn' and must not be modified or retained.
+// Remapping is blocked until 'fn' returns, so 'fn' must not call other
+// methods of the same pager.
+func (p *Pager) View(id int, fn func(d []byte) error) error {
+	// page in the pool may be more recent than the mapped page.
+	if pool := p.getPool(); pool != nil {
+		buf := make([]byte, p.pageSize)
+		if pool.read(p, id, buf) {
+			return fn(buf)
+		}
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
 	if id < 0 || id >= p.count {
 		return fmt.Errorf("invalid page id=%d (max=%d)", id, p.count-1)
-	} else if len(d) > p.pageSize {
-		return errors.New("data is larger than a page")
 	} else if p.file == nil {
 		return os.ErrClosed
-	} else if p.readOnly {
-		return ErrReadOnly
 	}
 
 	if p.data != nil {
-		copy(p.data[p.offset(id):], d)
-		p.writes++
-		return nil
+		off := p.offset(id)
+		end := off + int64(p.pageSize)
+		p.stats.read(p.pageSize)
+		return fn(p.data[off:end:end])
 	}
 
-	_, err := p.file.WriteAt(d, p.offset(id))
-	if err != nil {
+	buf := make([]byte, p.pageSize)
+	if err := p.readPage(id, buf); err != nil {
+		return err
+	}
+	return fn(buf)
+}
+
+// Write writes one page of data to the page with given id. Returns error if
+// the data is larger than a page. Data smaller than a page is zero padded.
+// If the page is in the buffer pool, the cached copy is updated as well.
+// Returns ErrPinned if the page is pinned.
+func (p *Pager) Write(id int, d []byte) error {
+	defer p.stats.writeLatency.since(time.Now())
+
+	if len(d) > p.pageSize {
+		return errors.New("data is larger than a page")
+	}
+
+	pool := p.getPool()
+	if pool != nil && pool.pinned(p, id) {
+		return ErrPinned
+	}
+
+	if err := p.store(id, d); err != nil {
+		return err
+	}
+
+	if pool != nil {
+		pool.update(p, id, d)
+	}
+	return nil
+}
+
+// ReadRange reads 'n' sequential pages starting at 'start' and returns the
+// data of all the pages back to back. Pages are read using a single read
+// (or copy from the mapped region) where possible. Pages in the buffer pool
+// are returned from the pool.
+func (p *Pager) ReadRange(start, n int) ([]byte, error) {
+	defer p.stats.readLatency.since(time.Now())
+
+	if n <= 0 {
+		return nil, errors.New("page count must be positive")
+	}
+
+	buf := make([]byte, n*p.pageSize)
+	if err := p.loadRange(start, n, buf); err != nil {
+		return nil, err
+	}
+
+	if pool := p.getPool(); pool != nil {
+		for i := 0; i < n; i++ {
+			pool.read(p, start+i, buf[i*p.pageSize:(i+1)*p.pageSize])
+		}
+	}
+	return buf, nil
+}
+
+// WriteMany writes the pages in the map. Writes are sorted by page id and
+// pages with contiguous ids are written using a single write (or copy into
+// the mapped region) where possible. Pages smaller than the page size are
+// zero padded. Cached copies in the buffer pool are updated as well.
+// Returns ErrPinned if any of the pages is pinned.
+func (p *Pager) WriteMany(pages map[int][]byte) error {
+	defer p.stats.writeLatency.since(time.Now())
+
+	ids := make([]int, 0, len(pages))
+	for id, d := range pages {
+		if len(d) > p.pageSize {
+			return errors.New("data is larger than a page")
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	pool := p.getPool()
+	if pool != nil && pool.pinned(p, ids...) {
+		return ErrPinned
+	}
+
+	if err := p.storeMany(ids, pages); err != nil {
 		return err
 	}
-	p.writes++
+
+	if pool != nil {
+		for _, id := range ids {
+			pool.update(p, id, pages[id])
+		}
+	}
+	return nil
+}
+
+// Pin returns the buffer pool frame holding the page with given id, reading
+// it into the pool if required. The page stays in the pool until it is
+// released using Unpin(). If no pool is set using SetPool(), a pool with
+// DefaultPoolFrames frames is created for the pager.
+func (p *Pager) Pin(id int) (*Page, error) {
+	p.mu.Lock()
+	if p.file == nil {
+		p.mu.Unlock()
+		return nil, os.ErrClosed
+	}
+
+	if p.pool == nil {
+		p.pool = NewPool(DefaultPoolFrames)
+	}
+	pool := p.pool
+	p.mu.Unlock()
+
+	return pool.pin(p, id)
+}
+
+// Unpin releases the page pinned using Pin(). If 'dirty' is true, the page
+// data was modified and will be written back to the file when the page is
+// evicted, flushed or the pager is closed.
+func (p *Pager) Unpin(page *Page, dirty bool) {
+	if dirty && p.readOnly {
+		dirty = false
+	}
+
+	if pool := p.getPool(); pool != nil && page != nil && page.owner == p {
+		pool.unpin(page, dirty)
+	}
+}
+
+// SetPool sets the buffer pool to be used by Pin() and Unpin(). Multiple
+// pagers can share a pool to use one memory budget. Pages of the pager in
+// the current pool are written back and released.
+func (p *Pager) SetPool(pool *Pool) error {
+	if old := p.getPool(); old != nil {
+		if err := old.release(p); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	p.pool = pool
+	p.mu.Unlock()
 	return nil
 }
 
+// Sync flushes the memory mapped region (msync) and the underlying file
+// (fsync) to stable storage. Writes acknowledged before Sync() returns are
+// durable unless Sync() returns error.
+func (p *Pager) Sync() error {
+	if p.readOnly {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		d := time.Since(start)
+		atomic.AddInt64(&p.stats.syncs, 1)
+		atomic.AddInt64(&p.stats.syncTime, int64(d))
+		p.stats.syncLatency.observe(d)
+	}()
+
+	if pool := p.getPool(); pool != nil {
+		if err := pool.flush(p); err != nil {
+			return err
+		}
+	}
+
+	if p.ptt != nil {
+		if err := p.commitTable(); err != nil {
+			return err
+		}
+	}
+
+	// flush holding mu shared so that readers are not blocked for the whole
+	// disk flush. Remaps and Close() hold mu exclusively, so the mapped
+	// region and the file stay valid.
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.file == nil {
+		return os.ErrClosed
+	}
+
+	if p.data != nil {
+		if err := p.data.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if s, ok := p.file.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// commitTable writes the translation table of a compressed file holding mu
+// exclusively.
+func (p *Pager) commitTable() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.file == nil {
+		return os.ErrClosed
+	}
+	return p.writeTable()
+}
+
 // Marshal writes the marshaled value of 'v' into page with given id.
 func (p *Pager) Marshal(id int, v encoding.BinaryMarshaler) error {
 	d, err := v.MarshalBinary()
@@ -202,33 +669,66 @@ func (p *Pager) PageSize() int { return p.pageSize }
 
 // Count returns the number of pages in the underlying file. Returns error if
 // the file is closed.
-func (p *Pager) Count() int { return p.count }
+func (p *Pager) Count() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.count
+}
+
+// Owner returns the owner recorded in the file header.
+func (p *Pager) Owner() Owner { return p.header.owner }
+
+// Created returns the creation time recorded in the file header. Returns
+// zero time if not recorded (e.g., migrated files).
+func (p *Pager) Created() time.Time { return p.header.created() }
 
 // ReadOnly returns true if the pager instance is in read-only mode.
 func (p *Pager) ReadOnly() bool { return p.readOnly }
 
 // Close closes the underlying file and marks the pager as closed for use.
 func (p *Pager) Close() error {
+	var poolErr error
+	if pool := p.getPool(); pool != nil {
+		poolErr = pool.release(p)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	if p.file == nil {
 		return nil
 	}
+
+	if p.ptt != nil && !p.readOnly {
+		if err := p.writeTable(); err != nil && poolErr == nil {
+			poolErr = err
+		}
+	}
+
 	_ = p.unmap()
+
 	err := p.file.Close()
 	p.osFile = nil
 	p.file = nil
+	if err == nil {
+		err = poolErr
+	}
 	return err
 }
 
-// Stats returns i/o stats collected by this pager.
-func (p *Pager) Stats() Stats {
-	return Stats{
-		Allocs: p.allocs,
-		Reads:  p.reads,
-		Writes: p.writes,
-	}
-}
+// Stats returns i/o stats collected by this pager since it was opened or
+// the stats were reset.
+func (p *Pager) Stats() Stats { return p.stats.snapshot() }
+
+// ResetStats resets all the i/o stats collected by this pager. Stats are
+// not reset atomically as a whole, so concurrent operations may be counted
+// partially.
+func (p *Pager) ResetStats() { p.stats.reset() }
 
 func (p *Pager) String() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
 	if p.file == nil {
 		return fmt.Sprintf("Pager{closed=true}")
 	}
@@ -239,28 +739,290 @@ func (p *Pager) String() string {
 	)
 }
 
-func (p *Pager) computeCount() {
-	p.count = int(p.fileSize) / p.pageSize
+// init reads and validates the pager header of an existing file, or writes
+// a new header if the file is empty.
+func (p *Pager) init(opts Options) error {
+	if opts.EncryptionKey != nil {
+		aead, err := newCipher(opts.EncryptionKey)
+		if err != nil {
+			return err
+		}
+		p.aead = aead
+	}
+
+	if opts.Compression && p.aead != nil {
+		return errors.New("compression cannot be combined with encryption")
+	} else if p.direct && (p.aead != nil || opts.Compression) {
+		return errors.New("direct I/O cannot be combined with encryption or compression")
+	}
+
+	pageSize := opts.PageSize
+	if p.fileSize == 0 {
+		if pageSize == 0 {
+			pageSize = os.Getpagesize()
+		} else if pageSize < headerSz {
+			return fmt.Errorf("invalid page size %d", pageSize)
+		}
+
+		if p.direct && pageSize%directAlignment != 0 {
+			return fmt.Errorf("page size must be a multiple of %d for direct I/O", directAlignment)
+		}
+		p.pageSize = pageSize
+
+		if p.readOnly {
+			return nil
+		}
+
+		p.header = header{
+			magic:   magic,
+			version: version,
+			pageSz:  uint32(pageSize),
+			owner:   opts.Owner,
+			ctime:   time.Now().UnixNano(),
+		}
+		if p.aead != nil {
+			keyCheck, err := sealKeyCheck(p.aead)
+			if err != nil {
+				return err
+			}
+			p.header.flags |= flagEncrypted
+			p.header.keyCheck = keyCheck
+		} else if opts.Compression {
+			p.header.flags |= flagCompressed
+			p.ptt = &translationTable{}
+		}
+
+		if err := p.file.Truncate(int64(pageSize)); err != nil {
+			return err
+		}
+		p.fileSize = int64(pageSize)
+		return p.writeHeader()
+	}
+
+	d := make([]byte, headerSz)
+	if _, err := p.readAt(d, 0); err != nil && err != io.EOF {
+		return err
+	}
+
+	h := header{}
+	if err := h.UnmarshalBinary(d); err != nil {
+		return err
+	} else if err := h.validate(); err != nil {
+		return err
+	} else if pageSize != 0 && pageSize != int(h.pageSz) {
+		return fmt.Errorf("page size %d does not match file (%d)", pageSize, h.pageSz)
+	} else if opts.Owner != OwnerNone && h.owner != OwnerNone && h.owner != opts.Owner {
+		return ErrOwnerMismatch
+	}
+
+	if h.flags&flagEncrypted == 0 && p.aead != nil {
+		return errors.New("file is not encrypted")
+	} else if h.flags&flagEncrypted != 0 {
+		if p.aead == nil {
+			return ErrKeyRequired
+		} else if err := verifyKeyCheck(p.aead, h.keyCheck); err != nil {
+			return err
+		}
+	}
+
+	if p.direct && (h.flags&flagCompressed != 0 || int(h.pageSz)%directAlignment != 0) {
+		return errors.New("file cannot be opened for direct I/O")
+	}
+
+	p.header = h
+	p.pageSize = int(h.pageSz)
+	p.count = int(h.count)
+
+	// claim the files created without an owner (e.g., migrated files).
+	if !p.readOnly && h.owner == OwnerNone && opts.Owner != OwnerNone {
+		p.header.owner = opts.Owner
+		if err := p.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	if h.flags&flagCompressed != 0 {
+		return p.loadTable()
+	} else if p.offset(p.count) > p.fileSize {
+		return errors.New("page count in pager header exceeds file size")
+	}
+	return nil
 }
 
+// grow extends the file to be at-least 'required' bytes. Caller must hold
+// mu exclusively. File size is doubled until the growth reaches the growth
+// chunk size. Region larger than the file is mapped, so remapping is
+// required only if the file outgrows the mapped region.
+func (p *Pager) grow(required int64) error {
+	target := fileutil.GrowSize(p.fileSize, required, p.growth, int64(p.pageSize))
+
+	var err error
+	if p.osFile != nil {
+		err = fileutil.Allocate(p.osFile, p.fileSize, target)
+	} else {
+		err = p.file.Truncate(target)
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&p.stats.truncates, 1)
+	p.fileSize = target
+
+	if p.data == nil || target > p.mapSize {
+		return p.mmap()
+	}
+	return nil
+}
+
+// allocFree pops a page from the free list. Caller must hold mu
+// exclusively.
+func (p *Pager) allocFree() (int, error) {
+	id := int(p.header.free) - 1
+
+	d := make([]byte, p.pageSize)
+	if err := p.readPage(id, d); err != nil {
+		return 0, err
+	}
+	p.header.free = bin.Uint32(d[0:4])
+
+	if err := p.writePage(id, make([]byte, p.pageSize)); err != nil {
+		return 0, err
+	}
+
+	atomic.AddInt64(&p.stats.allocs, 1)
+	return id, p.updateHeader()
+}
+
+// updateHeader persists the page count and the free list head after they
+// change. Header of a compressed file must not refer to pages missing from
+// the translation table on disk, so it is written along with the table by
+// writeTable() instead.
+func (p *Pager) updateHeader() error {
+	if p.ptt != nil {
+		p.ptt.dirty = true
+		return nil
+	}
+	return p.writeHeader()
+}
+
+func (p *Pager) writeHeader() error {
+	d, _ := p.header.MarshalBinary()
+	if p.data != nil {
+		copy(p.data, d)
+		return nil
+	}
+
+	_, err := p.writeAt(d, 0)
+	return err
+}
+
+// readPage reads the page into 'buf'. Caller must hold mu.
+func (p *Pager) readPage(id int, buf []byte) error {
+	if id < 0 || id >= p.count {
+		return fmt.Errorf("invalid page id=%d (max=%d)", id, p.count-1)
+	} else if p.file == nil {
+		return os.ErrClosed
+	} else if p.aead != nil {
+		return p.readSealed(id, buf)
+	} else if p.ptt != nil {
+		return p.readCompressed(id, buf)
+	}
+
+	if p.data != nil {
+		n := copy(buf, p.data[p.offset(id):])
+		if n < p.pageSize {
+			return io.EOF
+		}
+		p.stats.read(n)
+		return nil
+	}
+
+	n, err := p.readAt(buf, p.offset(id))
+	if n < p.pageSize {
+		return io.EOF
+	}
+	p.stats.read(n)
+	return err
+}
+
+// writePage writes the page. Caller must hold mu, exclusively if the
+// pages are compressed.
+func (p *Pager) writePage(id int, d []byte) error {
+	if id < 0 || id >= p.count {
+		return fmt.Errorf("invalid page id=%d (max=%d)", id, p.count-1)
+	} else if p.file == nil {
+		return os.ErrClosed
+	} else if p.readOnly {
+		return ErrReadOnly
+	} else if p.aead != nil {
+		return p.writeSealed(id, d)
+	} else if p.ptt != nil {
+		return p.writeCompressed(id, d)
+	}
+
+	if len(d) < p.pageSize {
+		// zero pad like the other write paths, so that no stale bytes of
+		// the previous page data are left behind.
+		page := make([]byte, p.pageSize)
+		copy(page, d)
+		d = page
+	}
+
+	if p.data != nil {
+		copy(p.data[p.offset(id):], d)
+		p.stats.write(len(d))
+		return nil
+	}
+
+	_, err := p.writeAt(d, p.offset(id))
+	if err != nil {
+		return err
+	}
+	p.stats.write(len(d))
+	return nil
+}
+
+// offset returns the file offset of the page. Pages are stored after the
+// header page.
 func (p *Pager) offset(id int) int64 {
-	return int64(p.pageSize * id)
+	return int64(p.pageSize) + int64(p.slotSize())*int64(id)
+}
+
+// slotSize returns the space occupied by a page in the file. Encrypted pages
+// require extra space for the nonce and the authentication tag.
+func (p *Pager) slotSize() int {
+	if p.aead != nil {
+		return p.pageSize + sealOverhead
+	}
+	return p.pageSize
 }
 
 func (p *Pager) mmap() error {
-	if disableMmap || p.osFile == nil || p.file == nil || p.fileSize <= 0 {
+	// encrypted and compressed pages cannot be accessed in-place.
+	if p.ioMode != IOMmap || p.aead != nil || p.ptt != nil || p.osFile == nil || p.file == nil || p.fileSize <= 0 {
 		return nil
 	}
 
+	remap := p.data != nil
 	if err := p.unmap(); err != nil {
 		return err
 	}
 
-	d, err := mmap.Map(p.osFile, p.mmapFlag, 0)
+	mapSize := p.fileSize
+	if !p.readOnly {
+		mapSize = fileutil.MapRegionSize(p.fileSize)
+	}
+
+	d, err := mmap.MapRegion(p.osFile, int(mapSize), p.mmapFlag, 0, 0)
 	if err != nil {
 		return err
 	}
+	atomic.AddInt64(&p.stats.maps, 1)
+	if remap {
+		atomic.AddInt64(&p.stats.remaps, 1)
+	}
 	p.data = d
+	p.mapSize = mapSize
 	return nil
 }
 
@@ -268,19 +1030,68 @@ func (p *Pager) unmap() error {
 	if p.osFile == nil || p.data == nil {
 		return nil
 	}
-	return p.data.Unmap()
+	err := p.data.Unmap()
+	p.data = nil
+	p.mapSize = 0
+	return err
 }
 
-// Stats represents I/O statistics collected by the pager.
-type Stats struct {
-	Writes int
-	Reads  int
-	Allocs int
+// IOMode selects how the pager performs page I/O on files.
+type IOMode int
+
+// I/O modes supported.
+const (
+	// IOMmap memory maps the file and copies pages from and to the mapped
+	// region. View() exposes the mapped pages without copying.
+	IOMmap IOMode = iota
+
+	// IOPread uses buffered pread(2) and pwrite(2) through the page cache.
+	IOPread
+
+	// IODirect uses pread(2) and pwrite(2) with O_DIRECT bypassing the page
+	// cache. Supported only on Linux. Page size must be a multiple of 4096
+	// and encryption and compression cannot be used.
+	IODirect
+)
+
+func (m IOMode) String() string {
+	switch m {
+	case IOMmap:
+		return "mmap"
+	case IOPread:
+		return "pread"
+	case IODirect:
+		return "direct"
+	}
+	return fmt.Sprintf("IOMode(%d)", int(m))
 }
 
-func (s Stats) String() string {
-	return fmt.Sprintf(
-		"Stats{writes=%d, allocs=%d, reads=%d}",
-		s.Writes, s.Allocs, s.Reads,
-	)
+// SyncMode controls when the writes are flushed to stable storage and
+// decides the durability/latency trade-off.
+type SyncMode int
+
+// Sync modes supported.
+const (
+	// SyncNone never syncs explicitly and leaves write-back to the OS.
+	// Acknowledged writes may be lost on power loss.
+	SyncNone SyncMode = iota
+
+	// SyncOnCommit syncs after every commit (e.g., every Put()).
+	SyncOnCommit
+
+	// SyncPeriodic syncs in the background at a configured interval.
+	// Writes acknowledged within the last interval may be lost.
+	SyncPeriodic
+)
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncNone:
+		return "none"
+	case SyncOnCommit:
+		return "on-commit"
+	case SyncPeriodic:
+		return "periodic"
+	}
+	return fmt.Sprintf("SyncMode(%d)", int(m))
 }
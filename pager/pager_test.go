@@ -1,15 +1,21 @@
 package pager
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestPager(t *testing.T) {
 	t.Parallel()
 
-	p, err := Open(InMemoryFileName, os.Getpagesize(), false, os.ModePerm)
+	p, err := Open(InMemoryFileName, &Options{FileMode: os.ModePerm, PageSize: os.Getpagesize()})
 	if err != nil {
 		t.Fatalf("Open() unexpected error: %v", err)
 	}
@@ -58,3 +64,802 @@ func TestPager(t *testing.T) {
 		t.Errorf("Close() unexpected error: %#v", err)
 	}
 }
+
+func TestPager_Sync(t *testing.T) {
+	t.Parallel()
+
+	p, err := Open(filepath.Join(t.TempDir(), "sync.db"), &Options{FileMode: 0644, PageSize: os.Getpagesize()})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+
+	if _, err := p.Alloc(2); err != nil {
+		t.Fatalf("Alloc() unexpected error: %v", err)
+	}
+
+	if err := p.Write(1, []byte("durable")); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+
+	if err := p.Sync(); err != nil {
+		t.Errorf("Sync() unexpected error: %v", err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Errorf("Close() unexpected error: %v", err)
+	}
+
+	if err := p.Sync(); err != os.ErrClosed {
+		t.Errorf("Sync() expected ErrClosed after Close(), got %v", err)
+	}
+}
+
+func TestPager_Free(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "free.db")
+	p, err := Open(fileName, &Options{FileMode: 0644, PageSize: 512})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+
+	if _, err := p.Alloc(4); err != nil {
+		t.Fatalf("Alloc() unexpected error: %v", err)
+	}
+
+	if err := p.Write(2, []byte("garbage")); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+
+	if err := p.Free(1, 2); err != nil {
+		t.Fatalf("Free() unexpected error: %v", err)
+	}
+
+	if err := p.Free(4); err == nil {
+		t.Errorf("Free() expected error for invalid page id")
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	// free list must survive reopen and page size is read from the header.
+	p, err = Open(fileName, &Options{FileMode: 0644})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer p.Close()
+
+	if p.PageSize() != 512 {
+		t.Errorf("expected page size from header to be 512, got %d", p.PageSize())
+	}
+
+	for _, want := range []int{2, 1, 4} {
+		id, err := p.Alloc(1)
+		if err != nil {
+			t.Fatalf("Alloc() unexpected error: %v", err)
+		} else if id != want {
+			t.Errorf("Alloc() expected id=%d, got id=%d", want, id)
+		}
+
+		d, _ := p.Read(id)
+		if !reflect.DeepEqual(d, make([]byte, 512)) {
+			t.Errorf("Alloc() expected page %d to be zeroed", id)
+		}
+	}
+
+	if p.Count() != 5 {
+		t.Errorf("Count() expected 5, got %d", p.Count())
+	}
+
+	if _, err := Open(fileName, &Options{ReadOnly: true, PageSize: 1024}); err == nil {
+		t.Errorf("Open() expected error for mismatched page size")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "legacy.db")
+
+	// legacy files have no header page.
+	legacy := make([]byte, 3*512)
+	for i := 0; i < 3; i++ {
+		copy(legacy[i*512:], fmt.Sprintf("page-%d", i))
+	}
+	if err := ioutil.WriteFile(fileName, legacy, 0644); err != nil {
+		t.Fatalf("failed to write legacy file: %v", err)
+	}
+
+	if _, err := Open(fileName, &Options{ReadOnly: true, PageSize: 512}); err != ErrNoHeader {
+		t.Errorf("Open() expected ErrNoHeader, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := Migrate(fileName, 512); err != nil {
+			t.Fatalf("Migrate() unexpected error: %v", err)
+		}
+	}
+
+	p, err := Open(fileName, &Options{ReadOnly: true, PageSize: 512})
+	if err != nil {
+		t.Fatalf("Open() unexpected error after migration: %v", err)
+	}
+	defer p.Close()
+
+	if p.Count() != 3 {
+		t.Errorf("Count() expected 3, got %d", p.Count())
+	}
+
+	for i := 0; i < 3; i++ {
+		d, err := p.Read(i)
+		if err != nil {
+			t.Fatalf("Read(%d) unexpected error: %v", i, err)
+		}
+
+		if want := fmt.Sprintf("page-%d", i); string(d[:len(want)]) != want {
+			t.Errorf("Read(%d) expected '%s', got '%s'", i, want, d[:len(want)])
+		}
+	}
+}
+
+func TestPager_Alloc_Growth(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "growth.db")
+	p, err := Open(fileName, &Options{FileMode: 0644, PageSize: 512})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+
+	resizes := 0
+	fileSize := p.fileSize
+	for i := 0; i < 1000; i++ {
+		if id, err := p.Alloc(1); err != nil {
+			t.Fatalf("Alloc() unexpected error: %v", err)
+		} else if id != i {
+			t.Fatalf("Alloc() expected id=%d, got id=%d", i, id)
+		}
+
+		if p.fileSize != fileSize {
+			resizes++
+			fileSize = p.fileSize
+		}
+	}
+
+	if resizes > 11 {
+		t.Errorf("expected file to grow geometrically, resized %d times", resizes)
+	}
+
+	if p.Count() != 1000 {
+		t.Errorf("Count() expected 1000, got %d", p.Count())
+	}
+
+	if err := p.Write(999, []byte("last")); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	// page count must not include the pre-allocated pages.
+	p, err = Open(fileName, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer p.Close()
+
+	if p.Count() != 1000 {
+		t.Errorf("Count() expected 1000 after reopen, got %d", p.Count())
+	}
+
+	if d, err := p.Read(999); err != nil {
+		t.Errorf("Read() unexpected error: %v", err)
+	} else if string(d[:4]) != "last" {
+		t.Errorf("Read() expected 'last', got '%s'", d[:4])
+	}
+
+	if _, err := p.Read(1000); err == nil {
+		t.Errorf("Read() expected error for pre-allocated page")
+	}
+}
+
+func TestPager_View(t *testing.T) {
+	t.Parallel()
+
+	p, err := Open(filepath.Join(t.TempDir(), "view.db"), &Options{FileMode: 0644, PageSize: 512})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer p.Close()
+
+	if _, err := p.Alloc(2); err != nil {
+		t.Fatalf("Alloc() unexpected error: %v", err)
+	}
+
+	if err := p.Write(1, []byte("mapped")); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+
+	err = p.View(1, func(d []byte) error {
+		if len(d) != 512 || cap(d) != 512 {
+			t.Errorf("View() expected a page sized slice, got len=%d cap=%d", len(d), cap(d))
+		}
+
+		if string(d[:6]) != "mapped" {
+			t.Errorf("View() expected 'mapped', got '%s'", d[:6])
+		}
+
+		// must be the mapped region, not a copy.
+		if &d[0] != &p.data[p.offset(1)] {
+			t.Errorf("View() expected zero-copy slice of the mapped region")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("View() unexpected error: %v", err)
+	}
+
+	// dirty pages in the pool must be visible.
+	pg, err := p.Pin(1)
+	if err != nil {
+		t.Fatalf("Pin() unexpected error: %v", err)
+	}
+	copy(pg.Data, "pinned")
+	p.Unpin(pg, true)
+
+	_ = p.View(1, func(d []byte) error {
+		if string(d[:6]) != "pinned" {
+			t.Errorf("View() expected 'pinned', got '%s'", d[:6])
+		}
+		return nil
+	})
+
+	if err := p.View(2, func(d []byte) error { return nil }); err == nil {
+		t.Errorf("View() expected error for invalid page id")
+	}
+}
+
+func TestPager_Encryption(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "encrypted.db")
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	p, err := Open(fileName, &Options{FileMode: 0644, PageSize: 512, EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+
+	if _, err := p.Alloc(3); err != nil {
+		t.Fatalf("Alloc() unexpected error: %v", err)
+	}
+
+	if err := p.Write(1, []byte("top-secret")); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+
+	// allocated but unwritten pages are read as zeroes.
+	if d, err := p.Read(2); err != nil || !reflect.DeepEqual(d, make([]byte, 512)) {
+		t.Errorf("Read() expected zeroed page, got err=%v", err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	raw, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	} else if bytes.Contains(raw, []byte("top-secret")) {
+		t.Errorf("expected page data to be encrypted on disk")
+	}
+
+	wrongKey := []byte("fedcba9876543210fedcba9876543210")
+	if _, err := Open(fileName, &Options{ReadOnly: true, EncryptionKey: wrongKey}); err != ErrWrongKey {
+		t.Errorf("Open() expected ErrWrongKey, got %v", err)
+	}
+
+	if _, err := Open(fileName, &Options{ReadOnly: true}); err != ErrKeyRequired {
+		t.Errorf("Open() expected ErrKeyRequired, got %v", err)
+	}
+
+	p, err = Open(fileName, &Options{ReadOnly: true, EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+
+	if d, err := p.Read(1); err != nil {
+		t.Errorf("Read() unexpected error: %v", err)
+	} else if string(d[:10]) != "top-secret" {
+		t.Errorf("Read() expected 'top-secret', got '%s'", d[:10])
+	}
+	_ = p.Close()
+
+	// tampering must be detected.
+	off := 512 + (512 + sealOverhead) + nonceSz
+	raw[off] ^= 0xFF
+	if err := ioutil.WriteFile(fileName, raw, 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	p, err = Open(fileName, &Options{ReadOnly: true, EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+
+	if _, err := p.Read(1); err == nil {
+		t.Errorf("Read() expected error for tampered page")
+	}
+	_ = p.Close()
+
+	// zeroing an unwritten page must be detected as well.
+	off = 512 + 2*(512+sealOverhead)
+	copy(raw[off:off+512+sealOverhead], make([]byte, 512+sealOverhead))
+	if err := ioutil.WriteFile(fileName, raw, 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	p, err = Open(fileName, &Options{ReadOnly: true, EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer p.Close()
+
+	if _, err := p.Read(2); err == nil {
+		t.Errorf("Read() expected error for zeroed page")
+	}
+}
+
+func TestPager_Compression(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "compressed.db")
+	const count = 64
+
+	p, err := Open(fileName, &Options{FileMode: 0644, PageSize: 4096, Compression: true})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+
+	if _, err := p.Alloc(count); err != nil {
+		t.Fatalf("Alloc() unexpected error: %v", err)
+	}
+
+	for i := 0; i < count; i++ {
+		d := bytes.Repeat([]byte(fmt.Sprintf("page-%d ", i)), 64)
+		if err := p.Write(i, d); err != nil {
+			t.Fatalf("Write() unexpected error: %v", err)
+		}
+	}
+
+	// rewriting with data that compresses worse must not change the ids.
+	random := make([]byte, 4096)
+	for i := range random {
+		random[i] = byte(i*7919 + i/3)
+	}
+	if err := p.Write(3, random); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	p, err = Open(fileName, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer func() { _ = p.Close() }()
+
+	if p.Count() != count {
+		t.Errorf("Count() expected %d, got %d", count, p.Count())
+	}
+
+	if used := int(p.header.sectors) * sectorSz; used >= count*4096/4 {
+		t.Errorf("expected compressed pages to use less space, used %d bytes", used)
+	}
+
+	for i := 0; i < count; i++ {
+		want := bytes.Repeat([]byte(fmt.Sprintf("page-%d ", i)), 64)
+		if i == 3 {
+			want = random
+		}
+
+		d, err := p.Read(i)
+		if err != nil {
+			t.Fatalf("Read() unexpected error: %v", err)
+		}
+		if !bytes.Equal(d[:len(want)], want) || !isZero(d[len(want):]) {
+			t.Errorf("Read() page %d does not match the written data", i)
+		}
+	}
+}
+
+func TestPager_Compression_NoOverwrite(t *testing.T) {
+	t.Parallel()
+
+	p, err := Open(filepath.Join(t.TempDir(), "compressed.db"), &Options{FileMode: 0644, PageSize: 4096, Compression: true})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer func() { _ = p.Close() }()
+
+	if _, err := p.Alloc(1); err != nil {
+		t.Fatalf("Alloc() unexpected error: %v", err)
+	}
+	if err := p.Write(0, bytes.Repeat([]byte("first "), 64)); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+	if err := p.Sync(); err != nil {
+		t.Fatalf("Sync() unexpected error: %v", err)
+	}
+	committed := p.ptt.entries[0]
+
+	// the table on disk points to the committed extent, so rewrites must
+	// not overwrite or reuse it until the table is written again.
+	for i := 0; i < 3; i++ {
+		if err := p.Write(0, bytes.Repeat([]byte("second"), 64)); err != nil {
+			t.Fatalf("Write() unexpected error: %v", err)
+		}
+		e := p.ptt.entries[0]
+		if e.sector < committed.sector+committed.sectors() && committed.sector < e.sector+e.sectors() {
+			t.Fatalf("rewrite %d overlaps the committed extent: %+v, %+v", i, e, committed)
+		}
+	}
+
+	if err := p.Sync(); err != nil {
+		t.Fatalf("Sync() unexpected error: %v", err)
+	}
+	if len(p.ptt.pending) != 0 {
+		t.Errorf("expected pending extents to be released after Sync(), got %v", p.ptt.pending)
+	}
+	if len(p.ptt.free) == 0 || p.ptt.free[0].start != committed.sector {
+		t.Errorf("expected committed extent to be free after Sync(), free=%v", p.ptt.free)
+	}
+}
+
+func TestPager_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	p, err := Open(filepath.Join(t.TempDir(), "concurrent.db"), &Options{
+		FileMode:    0644,
+		PageSize:    512,
+		GrowthChunk: 4096,
+	})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer func() { _ = p.Close() }()
+
+	const workers, pages = 8, 100
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < pages; i++ {
+				id, err := p.Alloc(1)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				want := []byte(fmt.Sprintf("worker-%d-page-%d", w, i))
+				if err := p.Write(id, want); err != nil {
+					errs <- err
+					return
+				}
+
+				err = p.View(id, func(d []byte) error {
+					if !bytes.HasPrefix(d, want) {
+						return fmt.Errorf("page %d: expected '%s', got '%s'", id, want, d[:len(want)])
+					}
+					return nil
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if p.Count() != workers*pages {
+		t.Errorf("Count() expected %d, got %d", workers*pages, p.Count())
+	}
+
+	if st := p.Stats(); st.Allocs != workers*pages || st.Writes != workers*pages {
+		t.Errorf("unexpected stats: %s", st)
+	}
+}
+
+func TestPager_Lock(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "locked.db")
+
+	p, err := Open(fileName, &Options{FileMode: 0644, PageSize: 512})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+
+	if _, err := Open(fileName, &Options{FileMode: 0644}); err != ErrLocked {
+		t.Errorf("Open() expected ErrLocked for second writer, got %v", err)
+	}
+
+	if _, err := Open(fileName, &Options{ReadOnly: true}); err != ErrLocked {
+		t.Errorf("Open() expected ErrLocked for reader, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = p.Close()
+	}()
+
+	r1, err := Open(fileName, &Options{ReadOnly: true, LockTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("Open() expected lock to be acquired after close, got %v", err)
+	}
+	defer func() { _ = r1.Close() }()
+
+	// readers share the lock.
+	r2, err := Open(fileName, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Open() unexpected error for second reader: %v", err)
+	}
+	defer func() { _ = r2.Close() }()
+
+	if _, err := Open(fileName, &Options{FileMode: 0644, LockTimeout: 20 * time.Millisecond}); err != ErrLocked {
+		t.Errorf("Open() expected ErrLocked for writer while readers exist, got %v", err)
+	}
+}
+
+func TestPager_WriteMany_ReadRange(t *testing.T) {
+	t.Parallel()
+
+	for _, fileName := range []string{InMemoryFileName, filepath.Join(t.TempDir(), "vectored.db")} {
+		p, err := Open(fileName, &Options{FileMode: 0644, PageSize: 512})
+		if err != nil {
+			t.Fatalf("Open() unexpected error: %v", err)
+		}
+
+		if _, err := p.Alloc(6); err != nil {
+			t.Fatalf("Alloc() unexpected error: %v", err)
+		}
+
+		before := p.Stats()
+		err = p.WriteMany(map[int][]byte{
+			4: []byte("page-4"),
+			1: []byte("page-1"),
+			2: []byte("page-2"),
+			3: []byte("page-3"),
+		})
+		if err != nil {
+			t.Fatalf("WriteMany() unexpected error: %v", err)
+		}
+
+		// ids 1-4 are contiguous, so a single write of 4 pages is expected.
+		if diff := p.Stats().Sub(before); diff.Writes != 4 || diff.BytesWritten != 4*512 {
+			t.Errorf("expected 4 pages in 2048 bytes written, got %d in %d", diff.Writes, diff.BytesWritten)
+		}
+
+		// pinned page changes must be visible in the range.
+		pg, err := p.Pin(2)
+		if err != nil {
+			t.Fatalf("Pin() unexpected error: %v", err)
+		}
+		copy(pg.Data, "pinned")
+		p.Unpin(pg, true)
+
+		d, err := p.ReadRange(0, 6)
+		if err != nil {
+			t.Fatalf("ReadRange() unexpected error: %v", err)
+		} else if len(d) != 6*512 {
+			t.Fatalf("ReadRange() expected %d bytes, got %d", 6*512, len(d))
+		}
+
+		for i, want := range []string{"", "page-1", "pinned", "page-3", "page-4", ""} {
+			page := d[i*512 : (i+1)*512]
+			if !bytes.HasPrefix(page, []byte(want)) || !isZero(page[len(want):]) {
+				t.Errorf("page %d: expected '%s', got '%s'", i, want, page[:8])
+			}
+		}
+
+		if _, err := p.ReadRange(4, 3); err == nil {
+			t.Errorf("ReadRange() expected error for range beyond count")
+		}
+		if err := p.WriteMany(map[int][]byte{6: nil}); err == nil {
+			t.Errorf("WriteMany() expected error for invalid id")
+		}
+
+		_ = p.Close()
+	}
+}
+
+func TestPager_IOMode(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range []IOMode{IOMmap, IOPread, IODirect} {
+		fileName := filepath.Join(t.TempDir(), mode.String()+".db")
+
+		p, err := Open(fileName, &Options{FileMode: 0644, PageSize: 4096, IOMode: mode})
+		if err != nil {
+			if mode == IODirect {
+				t.Logf("skipping direct I/O: %v", err)
+				continue
+			}
+			t.Fatalf("Open(%s) unexpected error: %v", mode, err)
+		}
+
+		if _, err := p.Alloc(3); err != nil {
+			t.Fatalf("Alloc(%s) unexpected error: %v", mode, err)
+		}
+
+		if err := p.Write(1, []byte("hello")); err != nil {
+			t.Fatalf("Write(%s) unexpected error: %v", mode, err)
+		}
+		if err := p.WriteMany(map[int][]byte{2: []byte("world")}); err != nil {
+			t.Fatalf("WriteMany(%s) unexpected error: %v", mode, err)
+		}
+
+		if mapped := p.data != nil; mapped != (mode == IOMmap) {
+			t.Errorf("mode %s: expected mmap=%t, got %t", mode, mode == IOMmap, mapped)
+		}
+		_ = p.Close()
+
+		p, err = Open(fileName, &Options{ReadOnly: true, IOMode: mode})
+		if err != nil {
+			t.Fatalf("Open(%s) unexpected error: %v", mode, err)
+		}
+
+		d, err := p.ReadRange(1, 2)
+		if err != nil {
+			t.Fatalf("ReadRange(%s) unexpected error: %v", mode, err)
+		} else if string(d[:5]) != "hello" || string(d[4096:4096+5]) != "world" {
+			t.Errorf("mode %s: unexpected page data", mode)
+		}
+		_ = p.Close()
+	}
+
+	if _, err := Open(filepath.Join(t.TempDir(), "invalid.db"), &Options{IOMode: IOMode(10)}); err == nil {
+		t.Errorf("Open() expected error for invalid I/O mode")
+	}
+}
+
+func TestPager_Write_Short(t *testing.T) {
+	t.Parallel()
+
+	key := bytes.Repeat([]byte("k"), 16)
+	for name, opts := range map[string]Options{
+		"mmap":       {IOMode: IOMmap},
+		"pread":      {IOMode: IOPread},
+		"direct":     {IOMode: IODirect},
+		"encrypted":  {EncryptionKey: key},
+		"compressed": {Compression: true},
+	} {
+		opts.FileMode = 0644
+		opts.PageSize = 4096
+
+		p, err := Open(filepath.Join(t.TempDir(), name+".db"), &opts)
+		if err != nil {
+			if opts.IOMode == IODirect {
+				t.Logf("skipping direct I/O: %v", err)
+				continue
+			}
+			t.Fatalf("Open(%s) unexpected error: %v", name, err)
+		}
+
+		if _, err := p.Alloc(1); err != nil {
+			t.Fatalf("Alloc(%s) unexpected error: %v", name, err)
+		}
+
+		// short write replaces the whole page on every path.
+		if err := p.Write(0, bytes.Repeat([]byte("x"), 4096)); err != nil {
+			t.Fatalf("Write(%s) unexpected error: %v", name, err)
+		} else if err := p.Write(0, []byte("short")); err != nil {
+			t.Fatalf("Write(%s) unexpected error: %v", name, err)
+		}
+
+		d, err := p.Read(0)
+		if err != nil {
+			t.Fatalf("Read(%s) unexpected error: %v", name, err)
+		} else if !bytes.HasPrefix(d, []byte("short")) || !isZero(d[5:]) {
+			t.Errorf("%s: expected zero padded page, got %q...", name, d[:16])
+		}
+		_ = p.Close()
+	}
+}
+
+func TestPager_Header(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "owned.db")
+
+	before := time.Now()
+	p, err := Open(fileName, &Options{FileMode: 0644, PageSize: 512, Owner: OwnerBPlusTree})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+
+	if p.Owner() != OwnerBPlusTree {
+		t.Errorf("Owner() expected %s, got %s", OwnerBPlusTree, p.Owner())
+	}
+	if created := p.Created(); created.Before(before.Add(-time.Second)) || created.After(time.Now()) {
+		t.Errorf("Created() unexpected time %s", created)
+	}
+	_ = p.Close()
+
+	if _, err := Open(fileName, &Options{ReadOnly: true, Owner: OwnerLinearHash}); err != ErrOwnerMismatch {
+		t.Errorf("Open() expected ErrOwnerMismatch, got %v", err)
+	}
+
+	if _, err := Open(fileName, &Options{ReadOnly: true, PageSize: 1024}); err == nil {
+		t.Errorf("Open() expected error for page size mismatch")
+	}
+
+	p, err = Open(fileName, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Open() unexpected error without owner: %v", err)
+	}
+	_ = p.Close()
+
+	// files without an owner are claimed by the first writer.
+	unowned := filepath.Join(t.TempDir(), "unowned.db")
+	p, err = Open(unowned, &Options{FileMode: 0644, PageSize: 512})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	_ = p.Close()
+
+	p, err = Open(unowned, &Options{FileMode: 0644, Owner: OwnerExtHash})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	_ = p.Close()
+
+	p, err = Open(unowned, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer func() { _ = p.Close() }()
+
+	if p.Owner() != OwnerExtHash {
+		t.Errorf("Owner() expected %s, got %s", OwnerExtHash, p.Owner())
+	}
+}
+
+func TestPager_HeaderVersion(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "version.db")
+
+	p, err := Open(fileName, &Options{FileMode: 0644, PageSize: 512})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	_ = p.Close()
+
+	raw, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	raw[4] = version + 1
+	if err := ioutil.WriteFile(fileName, raw, 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	if _, err := Open(fileName, &Options{ReadOnly: true}); err == nil {
+		t.Errorf("Open() expected error for unknown header version")
+	}
+}
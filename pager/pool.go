@@ -0,0 +1,285 @@
+package pager
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DefaultPoolFrames is the number of frames in the buffer pool created for
+// a pager on the first Pin() if no pool is set using SetPool().
+const DefaultPoolFrames = 64
+
+// ErrPoolFull is returned by Pin() when all the frames in the buffer pool
+// are pinned and none can be evicted.
+var ErrPoolFull = errors.New("all buffer pool frames are pinned")
+
+// ErrPinned is returned by the writes bypassing the buffer pool (Write(),
+// WriteMany() and Free()) to a pinned page, since the write would discard
+// the changes made through the pinned frame.
+var ErrPinned = errors.New("page is pinned")
+
+// NewPool returns a buffer pool with the given number of frames. A pool can
+// be shared by multiple pagers (using SetPool) to put all of them under one
+// memory budget.
+func NewPool(frames int) *Pool {
+	if frames <= 0 {
+		frames = DefaultPoolFrames
+	}
+
+	return &Pool{
+		frames: make([]*Page, 0, frames),
+		table:  map[frameKey]*Page{},
+	}
+}
+
+// Pool is a fixed size cache of pages backed by one or more pagers. Pages
+// are pinned in the pool while in use and are evicted using the CLOCK
+// algorithm when a frame is required. Dirty pages are written back to the
+// owning pager on eviction, Flush() or when the pager is closed. Pool is
+// safe for concurrent use.
+type Pool struct {
+	mu     sync.Mutex
+	frames []*Page
+	table  map[frameKey]*Page
+	hand   int
+	stats  PoolStats
+}
+
+// Page is a buffer pool frame holding the data of one page. Data must not
+// be retained or modified after the page is unpinned.
+type Page struct {
+	ID   int
+	Data []byte
+
+	owner *Pager
+	pins  int
+	dirty bool
+	ref   bool
+}
+
+type frameKey struct {
+	owner *Pager
+	id    int
+}
+
+// Flush writes back all the dirty pages in the pool.
+func (pool *Pool) Flush() error { return pool.flush(nil) }
+
+// Stats returns the statistics collected by the pool.
+func (pool *Pool) Stats() PoolStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	st := pool.stats
+	st.Frames = cap(pool.frames)
+	st.Used = len(pool.frames)
+	for _, pg := range pool.frames {
+		if pg.pins > 0 {
+			st.Pinned++
+		}
+	}
+	return st
+}
+
+func (pool *Pool) pin(p *Pager, id int) (*Page, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pg, found := pool.table[frameKey{owner: p, id: id}]; found {
+		pool.stats.Hits++
+		pg.pins++
+		pg.ref = true
+		return pg, nil
+	}
+	pool.stats.Misses++
+
+	pg, err := pool.victim()
+	if err != nil {
+		return nil, err
+	}
+
+	if pg == nil {
+		pg = &Page{Data: make([]byte, p.pageSize)}
+		pool.frames = append(pool.frames, pg)
+	} else if len(pg.Data) != p.pageSize {
+		pg.Data = make([]byte, p.pageSize)
+	}
+
+	if err := p.load(id, pg.Data); err != nil {
+		// frame is unused, keep it around for the next pin.
+		pg.owner = nil
+		return nil, err
+	}
+
+	pg.ID = id
+	pg.owner = p
+	pg.pins = 1
+	pg.ref = true
+	pg.dirty = false
+	pool.table[frameKey{owner: p, id: id}] = pg
+	return pg, nil
+}
+
+func (pool *Pool) unpin(pg *Page, dirty bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pg.pins == 0 {
+		return
+	}
+	pg.pins--
+	pg.dirty = pg.dirty || dirty
+}
+
+// victim returns a free frame or evicts an unpinned frame using CLOCK. It
+// returns nil page if the pool can still grow.
+func (pool *Pool) victim() (*Page, error) {
+	for _, pg := range pool.frames {
+		if pg.owner == nil {
+			return pg, nil
+		}
+	}
+
+	if len(pool.frames) < cap(pool.frames) {
+		return nil, nil
+	}
+
+	// two sweeps clear all the reference bits, so no unpinned frame is
+	// found only if all frames are pinned.
+	for i := 0; i < 2*len(pool.frames); i++ {
+		pg := pool.frames[pool.hand]
+		pool.hand = (pool.hand + 1) % len(pool.frames)
+
+		if pg.pins > 0 {
+			continue
+		} else if pg.ref {
+			pg.ref = false
+			continue
+		}
+
+		if err := pool.writeBack(pg); err != nil {
+			return nil, err
+		}
+		delete(pool.table, frameKey{owner: pg.owner, id: pg.ID})
+		pg.owner = nil
+		pool.stats.Evictions++
+		return pg, nil
+	}
+
+	return nil, ErrPoolFull
+}
+
+func (pool *Pool) writeBack(pg *Page) error {
+	if !pg.dirty || pg.owner == nil {
+		return nil
+	}
+
+	if err := pg.owner.store(pg.ID, pg.Data); err != nil {
+		return err
+	}
+	pg.dirty = false
+	pool.stats.WriteBacks++
+	return nil
+}
+
+// flush writes back the dirty pages of the pager. If the pager is nil,
+// dirty pages of all pagers are written back.
+func (pool *Pool) flush(p *Pager) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for _, pg := range pool.frames {
+		if p != nil && pg.owner != p {
+			continue
+		}
+
+		if err := pool.writeBack(pg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read copies the cached page into 'buf' if the page is in the pool.
+func (pool *Pool) read(p *Pager, id int, buf []byte) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pg, found := pool.table[frameKey{owner: p, id: id}]
+	if !found {
+		return false
+	}
+	copy(buf, pg.Data)
+	return true
+}
+
+// pinned returns true if any of the pages is pinned in the pool.
+func (pool *Pool) pinned(p *Pager, ids ...int) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for _, id := range ids {
+		if pg, found := pool.table[frameKey{owner: p, id: id}]; found && pg.pins > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// update keeps the cached page, if any, in sync with the data written
+// directly through the pager. Writers must check that the page is not
+// pinned using pinned().
+func (pool *Pool) update(p *Pager, id int, d []byte) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pg, found := pool.table[frameKey{owner: p, id: id}]
+	if !found {
+		return
+	}
+	n := copy(pg.Data, d)
+	for i := n; i < len(pg.Data); i++ {
+		pg.Data[i] = 0
+	}
+	pg.dirty = false
+}
+
+// release writes back and drops all the pages of the pager from the pool.
+func (pool *Pool) release(p *Pager) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var firstErr error
+	for _, pg := range pool.frames {
+		if pg.owner != p {
+			continue
+		}
+
+		if err := pool.writeBack(pg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(pool.table, frameKey{owner: p, id: pg.ID})
+		pg.owner = nil
+		pg.pins = 0
+	}
+	return firstErr
+}
+
+// PoolStats represents statistics collected by the buffer pool.
+type PoolStats struct {
+	Frames     int // number of frames in the pool
+	Used       int // number of frames allocated
+	Pinned     int // number of frames pinned currently
+	Hits       int // pins served from the pool
+	Misses     int // pins that required a read from the pager
+	Evictions  int // frames evicted to make room
+	WriteBacks int // dirty frames written back to the pager
+}
+
+func (s PoolStats) String() string {
+	return fmt.Sprintf(
+		"PoolStats{frames=%d, used=%d, pinned=%d, hits=%d, misses=%d, evictions=%d, writebacks=%d}",
+		s.Frames, s.Used, s.Pinned, s.Hits, s.Misses, s.Evictions, s.WriteBacks,
+	)
+}
@@ -0,0 +1,148 @@
+package pager
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPager_Pin(t *testing.T) {
+	t.Parallel()
+
+	fileName := filepath.Join(t.TempDir(), "pool.db")
+	p, err := Open(fileName, &Options{FileMode: 0644, PageSize: os.Getpagesize()})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+
+	pool := NewPool(2)
+	if err := p.SetPool(pool); err != nil {
+		t.Fatalf("SetPool() unexpected error: %v", err)
+	}
+
+	if _, err := p.Alloc(4); err != nil {
+		t.Fatalf("Alloc() unexpected error: %v", err)
+	}
+
+	pg, err := p.Pin(1)
+	if err != nil {
+		t.Fatalf("Pin() unexpected error: %v", err)
+	}
+	copy(pg.Data, "dirty")
+	p.Unpin(pg, true)
+
+	// dirty page is visible through Read() before write-back.
+	if d, err := p.Read(1); err != nil || !bytes.HasPrefix(d, []byte("dirty")) {
+		t.Errorf("Read() expected cached data, got %q (err=%v)", d[:5], err)
+	}
+
+	// pin the page again to verify hits.
+	pg, err = p.Pin(1)
+	if err != nil {
+		t.Fatalf("Pin() unexpected error: %v", err)
+	}
+	p.Unpin(pg, false)
+
+	// direct writes must update the cached page.
+	if err := p.Write(1, []byte("write")); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+	pg, _ = p.Pin(1)
+	if !bytes.HasPrefix(pg.Data, []byte("write")) {
+		t.Errorf("Pin() expected written data, got %q", pg.Data[:5])
+	}
+	copy(pg.Data, "evict")
+	p.Unpin(pg, true)
+
+	// pin and hold two other pages, page 1 must be evicted and written back.
+	pg2, err := p.Pin(2)
+	if err != nil {
+		t.Fatalf("Pin(2) unexpected error: %v", err)
+	}
+	pg3, err := p.Pin(3)
+	if err != nil {
+		t.Fatalf("Pin(3) unexpected error: %v", err)
+	}
+
+	if _, err := p.Pin(0); err != ErrPoolFull {
+		t.Errorf("Pin() expected ErrPoolFull, got %v", err)
+	}
+
+	st := pool.Stats()
+	if st.Hits != 2 || st.Evictions != 1 || st.WriteBacks != 1 || st.Pinned != 2 {
+		t.Errorf("unexpected pool stats: %s", st)
+	}
+
+	d := make([]byte, p.PageSize())
+	if err := p.readPage(1, d); err != nil || !bytes.HasPrefix(d, []byte("evict")) {
+		t.Errorf("expected evicted page to be written back, got %q (err=%v)", d[:5], err)
+	}
+
+	copy(pg3.Data, "close")
+	p.Unpin(pg2, false)
+	p.Unpin(pg3, true)
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+
+	if st := pool.Stats(); st.Pinned != 0 || st.WriteBacks != 2 {
+		t.Errorf("expected pages to be released on close: %s", st)
+	}
+
+	p, err = Open(fileName, &Options{ReadOnly: true, PageSize: os.Getpagesize()})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer p.Close()
+
+	if d, err := p.Read(3); err != nil || !bytes.HasPrefix(d, []byte("close")) {
+		t.Errorf("expected dirty page to be written back on close, got %q (err=%v)", d[:5], err)
+	}
+}
+
+func TestPager_Pin_DirectWrite(t *testing.T) {
+	t.Parallel()
+
+	p, err := Open(filepath.Join(t.TempDir(), "pool.db"), &Options{FileMode: 0644, PageSize: 512})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer p.Close()
+
+	if _, err := p.Alloc(2); err != nil {
+		t.Fatalf("Alloc() unexpected error: %v", err)
+	}
+
+	pg, err := p.Pin(1)
+	if err != nil {
+		t.Fatalf("Pin() unexpected error: %v", err)
+	}
+	copy(pg.Data, "pinned")
+
+	// direct writes must not discard the changes of the pinned page.
+	if err := p.Write(1, []byte("direct")); err != ErrPinned {
+		t.Errorf("Write() expected ErrPinned, got %v", err)
+	}
+	if err := p.WriteMany(map[int][]byte{0: []byte("other"), 1: []byte("direct")}); err != ErrPinned {
+		t.Errorf("WriteMany() expected ErrPinned, got %v", err)
+	}
+	if err := p.Free(1); err != ErrPinned {
+		t.Errorf("Free() expected ErrPinned, got %v", err)
+	}
+
+	p.Unpin(pg, true)
+	if err := p.pool.Flush(); err != nil {
+		t.Fatalf("Flush() unexpected error: %v", err)
+	}
+
+	d := make([]byte, p.PageSize())
+	if err := p.readPage(1, d); err != nil || !bytes.HasPrefix(d, []byte("pinned")) {
+		t.Errorf("expected pinned changes to be flushed, got %q (err=%v)", d[:6], err)
+	}
+
+	// page can be written directly once unpinned.
+	if err := p.Write(1, []byte("direct")); err != nil {
+		t.Errorf("Write() unexpected error after Unpin(): %v", err)
+	}
+}
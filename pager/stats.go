@@ -0,0 +1,240 @@
+package pager
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// HistogramBuckets is the number of buckets in a latency Histogram. Bucket
+// 'i' counts the observations below BucketBound(i) that did not fit in the
+// previous buckets. The last bucket has no upper bound.
+const HistogramBuckets = 24
+
+// Stats represents I/O statistics collected by the pager. Stats of two
+// points in time can be diffed using Sub() to find the I/O performed in
+// between.
+type Stats struct {
+	Writes int // pages written
+	Reads  int // pages read
+	Allocs int // Alloc() calls
+	Frees  int // pages freed
+
+	BytesRead    int64 // bytes read from the file or the mapped region
+	BytesWritten int64 // bytes written to the file or the mapped region
+
+	Maps      int           // regions mapped including remaps
+	Remaps    int           // regions mapped to replace an existing one
+	Truncates int           // file resizes
+	Syncs     int           // Sync() calls
+	SyncTime  time.Duration // total time spent in Sync()
+
+	ReadLatency  Histogram // latency of Read()
+	WriteLatency Histogram // latency of Write()
+	AllocLatency Histogram // latency of Alloc()
+	SyncLatency  Histogram // latency of Sync()
+}
+
+// Sub returns the difference between the stats and an earlier snapshot.
+func (s Stats) Sub(prev Stats) Stats {
+	return Stats{
+		Writes:       s.Writes - prev.Writes,
+		Reads:        s.Reads - prev.Reads,
+		Allocs:       s.Allocs - prev.Allocs,
+		Frees:        s.Frees - prev.Frees,
+		BytesRead:    s.BytesRead - prev.BytesRead,
+		BytesWritten: s.BytesWritten - prev.BytesWritten,
+		Maps:         s.Maps - prev.Maps,
+		Remaps:       s.Remaps - prev.Remaps,
+		Truncates:    s.Truncates - prev.Truncates,
+		Syncs:        s.Syncs - prev.Syncs,
+		SyncTime:     s.SyncTime - prev.SyncTime,
+		ReadLatency:  s.ReadLatency.Sub(prev.ReadLatency),
+		WriteLatency: s.WriteLatency.Sub(prev.WriteLatency),
+		AllocLatency: s.AllocLatency.Sub(prev.AllocLatency),
+		SyncLatency:  s.SyncLatency.Sub(prev.SyncLatency),
+	}
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf(
+		"Stats{writes=%d, allocs=%d, frees=%d, reads=%d, bytesRead=%d, bytesWritten=%d, "+
+			"maps=%d, remaps=%d, truncates=%d, syncs=%d, syncTime=%s}",
+		s.Writes, s.Allocs, s.Frees, s.Reads, s.BytesRead, s.BytesWritten,
+		s.Maps, s.Remaps, s.Truncates, s.Syncs, s.SyncTime,
+	)
+}
+
+// Histogram is a latency histogram with exponentially growing buckets.
+type Histogram struct {
+	Count   int
+	Sum     time.Duration
+	Buckets [HistogramBuckets]int
+}
+
+// BucketBound returns the exclusive upper bound of the bucket with given
+// index. Bounds start at 1µs and double with every bucket.
+func BucketBound(i int) time.Duration { return time.Microsecond << uint(i) }
+
+// Mean returns the average latency observed.
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile returns the upper bound of the bucket containing the q-th
+// quantile (0 <= q <= 1) of the observations. Observations in the last
+// bucket are reported as the bound of the previous bucket.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	rank := int(q * float64(h.Count))
+	if rank < 1 {
+		rank = 1
+	}
+
+	seen := 0
+	for i, n := range h.Buckets[:HistogramBuckets-1] {
+		seen += n
+		if seen >= rank {
+			return BucketBound(i)
+		}
+	}
+	return BucketBound(HistogramBuckets - 2)
+}
+
+// Sub returns the difference between the histogram and an earlier snapshot.
+func (h Histogram) Sub(prev Histogram) Histogram {
+	res := Histogram{
+		Count: h.Count - prev.Count,
+		Sum:   h.Sum - prev.Sum,
+	}
+	for i := range h.Buckets {
+		res.Buckets[i] = h.Buckets[i] - prev.Buckets[i]
+	}
+	return res
+}
+
+func (h Histogram) String() string {
+	return fmt.Sprintf(
+		"Histogram{count=%d, mean=%s, p50=%s, p99=%s}",
+		h.Count, h.Mean(), h.Quantile(0.5), h.Quantile(0.99),
+	)
+}
+
+// counters holds the stats of a pager. All fields are updated atomically,
+// so counters must be 64-bit aligned.
+type counters struct {
+	writes       int64
+	reads        int64
+	allocs       int64
+	frees        int64
+	bytesRead    int64
+	bytesWritten int64
+	maps         int64
+	remaps       int64
+	truncates    int64
+	syncs        int64
+	syncTime     int64
+
+	readLatency  histogram
+	writeLatency histogram
+	allocLatency histogram
+	syncLatency  histogram
+}
+
+func (c *counters) read(n int)  { c.readMany(1, n) }
+func (c *counters) write(n int) { c.writeMany(1, n) }
+
+// readMany records 'pages' pages read using a single read of 'n' bytes.
+func (c *counters) readMany(pages, n int) {
+	atomic.AddInt64(&c.reads, int64(pages))
+	atomic.AddInt64(&c.bytesRead, int64(n))
+}
+
+// writeMany records 'pages' pages written using a single write of 'n' bytes.
+func (c *counters) writeMany(pages, n int) {
+	atomic.AddInt64(&c.writes, int64(pages))
+	atomic.AddInt64(&c.bytesWritten, int64(n))
+}
+
+func (c *counters) snapshot() Stats {
+	load := func(v *int64) int { return int(atomic.LoadInt64(v)) }
+
+	return Stats{
+		Writes:       load(&c.writes),
+		Reads:        load(&c.reads),
+		Allocs:       load(&c.allocs),
+		Frees:        load(&c.frees),
+		BytesRead:    atomic.LoadInt64(&c.bytesRead),
+		BytesWritten: atomic.LoadInt64(&c.bytesWritten),
+		Maps:         load(&c.maps),
+		Remaps:       load(&c.remaps),
+		Truncates:    load(&c.truncates),
+		Syncs:        load(&c.syncs),
+		SyncTime:     time.Duration(atomic.LoadInt64(&c.syncTime)),
+		ReadLatency:  c.readLatency.snapshot(),
+		WriteLatency: c.writeLatency.snapshot(),
+		AllocLatency: c.allocLatency.snapshot(),
+		SyncLatency:  c.syncLatency.snapshot(),
+	}
+}
+
+func (c *counters) reset() {
+	for _, v := range []*int64{
+		&c.writes, &c.reads, &c.allocs, &c.frees, &c.bytesRead,
+		&c.bytesWritten, &c.maps, &c.remaps, &c.truncates, &c.syncs,
+		&c.syncTime,
+	} {
+		atomic.StoreInt64(v, 0)
+	}
+
+	c.readLatency.reset()
+	c.writeLatency.reset()
+	c.allocLatency.reset()
+	c.syncLatency.reset()
+}
+
+// histogram is the atomically updated counterpart of Histogram.
+type histogram struct {
+	count   int64
+	sum     int64
+	buckets [HistogramBuckets]int64
+}
+
+// since records the time elapsed since 'start'. Meant to be deferred.
+func (h *histogram) since(start time.Time) { h.observe(time.Since(start)) }
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < HistogramBuckets-1 && d >= BucketBound(i) {
+		i++
+	}
+
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	atomic.AddInt64(&h.buckets[i], 1)
+}
+
+func (h *histogram) snapshot() Histogram {
+	res := Histogram{
+		Count: int(atomic.LoadInt64(&h.count)),
+		Sum:   time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+	for i := range h.buckets {
+		res.Buckets[i] = int(atomic.LoadInt64(&h.buckets[i]))
+	}
+	return res
+}
+
+func (h *histogram) reset() {
+	atomic.StoreInt64(&h.count, 0)
+	atomic.StoreInt64(&h.sum, 0)
+	for i := range h.buckets {
+		atomic.StoreInt64(&h.buckets[i], 0)
+	}
+}
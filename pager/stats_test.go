@@ -0,0 +1,94 @@
+package pager
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPager_Stats(t *testing.T) {
+	t.Parallel()
+
+	p, err := Open(filepath.Join(t.TempDir(), "stats.db"), &Options{
+		FileMode:    0644,
+		PageSize:    512,
+		GrowthChunk: 4096,
+	})
+	if err != nil {
+		t.Fatalf("Open() unexpected error: %v", err)
+	}
+	defer func() { _ = p.Close() }()
+
+	if _, err := p.Alloc(4); err != nil {
+		t.Fatalf("Alloc() unexpected error: %v", err)
+	}
+	before := p.Stats()
+
+	if err := p.Write(1, []byte("hello")); err != nil {
+		t.Fatalf("Write() unexpected error: %v", err)
+	}
+	if _, err := p.Read(1); err != nil {
+		t.Fatalf("Read() unexpected error: %v", err)
+	}
+	if err := p.Sync(); err != nil {
+		t.Fatalf("Sync() unexpected error: %v", err)
+	}
+
+	diff := p.Stats().Sub(before)
+	// short writes are zero padded to a page.
+	if diff.Writes != 1 || diff.BytesWritten != 512 {
+		t.Errorf("expected 1 write of 512 bytes, got %d writes of %d bytes", diff.Writes, diff.BytesWritten)
+	}
+	if diff.Reads != 1 || diff.BytesRead != 512 {
+		t.Errorf("expected 1 read of 512 bytes, got %d reads of %d bytes", diff.Reads, diff.BytesRead)
+	}
+	if diff.Syncs != 1 || diff.SyncLatency.Count != 1 || diff.SyncTime != diff.SyncLatency.Sum {
+		t.Errorf("unexpected sync stats: %s, %s", diff, diff.SyncLatency)
+	}
+	if diff.ReadLatency.Count != 1 || diff.WriteLatency.Count != 1 || diff.AllocLatency.Count != 0 {
+		t.Errorf("unexpected latency counts: read=%d, write=%d, alloc=%d",
+			diff.ReadLatency.Count, diff.WriteLatency.Count, diff.AllocLatency.Count)
+	}
+
+	// growing beyond the mapped region must remap.
+	if _, err := p.Alloc(4096); err != nil {
+		t.Fatalf("Alloc() unexpected error: %v", err)
+	}
+	if st := p.Stats(); st.Truncates == 0 || st.Remaps == 0 || st.Maps <= st.Remaps {
+		t.Errorf("expected truncates and remaps to be counted, got %s", st)
+	}
+
+	p.ResetStats()
+	if st := p.Stats(); st != (Stats{}) {
+		t.Errorf("expected zero stats after reset, got %s", st)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	t.Parallel()
+
+	var h histogram
+	for _, d := range []time.Duration{
+		500 * time.Nanosecond, 3 * time.Microsecond, 3 * time.Microsecond, time.Hour,
+	} {
+		h.observe(d)
+	}
+
+	snap := h.snapshot()
+	if snap.Count != 4 {
+		t.Errorf("expected count 4, got %d", snap.Count)
+	}
+	if snap.Buckets[0] != 1 || snap.Buckets[2] != 2 || snap.Buckets[HistogramBuckets-1] != 1 {
+		t.Errorf("unexpected buckets: %v", snap.Buckets)
+	}
+	if q := snap.Quantile(0.5); q != 4*time.Microsecond {
+		t.Errorf("expected p50 of 4µs, got %s", q)
+	}
+	if q := snap.Quantile(0.25); q != time.Microsecond {
+		t.Errorf("expected p25 of 1µs, got %s", q)
+	}
+
+	if diff := snap.Sub(snap); diff.Count != 0 || diff.Sum != 0 || diff.Mean() != 0 {
+		t.Errorf("expected empty diff, got %s", diff)
+	}
+}
@@ -0,0 +1,42 @@
+//+build ondisk
+
+package index_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spy16/kiwi/index/linearhash"
+)
+
+func TestLinearHash(t *testing.T) {
+	fileName := "kiwi_linearhash.idx"
+	_ = os.Remove(fileName)
+
+	t.Logf("using file '%s'...", fileName)
+
+	idx, err := linearhash.Open(fileName, &linearhash.Options{
+		ReadOnly: false,
+		FileMode: 0664,
+	})
+	if err != nil {
+		t.Fatalf("failed to init linear hash: %v", err)
+	}
+	defer func() {
+		_ = idx.Close()
+		_ = os.Remove(fileName)
+	}()
+
+	count := uint32(10000)
+	writeTime, err := writeALot(idx, count)
+	if err != nil {
+		t.Errorf("error while Put(): %v", err)
+	}
+	t.Logf("took %s to Put %d entris", writeTime, count)
+
+	readTime, err := readALot(idx, count)
+	if err != nil {
+		t.Errorf("error while Get(): %v", err)
+	}
+	t.Logf("took %s to Get %d entris", readTime, count)
+}